@@ -1,3 +1,10 @@
 module part2
 
 go 1.20
+
+require (
+	golang.org/x/crypto v0.15.0
+	golang.org/x/net v0.18.0
+)
+
+require golang.org/x/sys v0.14.0 // indirect
@@ -0,0 +1,164 @@
+package reliable_udp
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// MaxSackRanges is the most SACK ranges one ACK carries
+const MaxSackRanges = 4
+
+// ackInfo is what an ACK tells the sender besides the sequence number
+type ackInfo struct {
+	window     int           // receiver's free buffer space in bytes, -1 if not advertised
+	sack       []sackRange   // received ranges above a cumulative ACK, lowest first
+	delay      time.Duration // how long the receiver held the ACK back
+	cumulative bool          // the ACK covers everything up to its sequence number
+}
+
+// sackRange is an inclusive range of received sequence numbers
+type sackRange struct {
+	start, end int64
+}
+
+// containsSeq reports whether any of ranges contains seq
+func containsSeq(ranges []sackRange, seq int64) bool {
+	for _, r := range ranges {
+		if seq >= r.start && seq <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeAck builds an ACK datagram for seq. The payload carries the fields
+// announced by the header flags, in flag order:
+//
+//	FlagWindow: free receive buffer space (uint32, bytes)
+//	FlagSack:     range count (uint8), then per range its start as an
+//	              offset from seq and its length minus one (uint32 each)
+//	FlagAckDelay: time the receiver held the ACK back (uint32, microseconds)
+//
+// FlagCumulative carries no payload.
+func encodeAck(seq int64, info ackInfo) []byte {
+	var flags uint16
+	var payload []byte
+	if info.window >= 0 {
+		flags |= FlagWindow
+		payload = binary.BigEndian.AppendUint32(payload, uint32(info.window))
+	}
+	if len(info.sack) > 0 {
+		flags |= FlagSack
+		payload = appendRanges(payload, seq, info.sack)
+	}
+	if info.delay > 0 {
+		flags |= FlagAckDelay
+		payload = binary.BigEndian.AppendUint32(payload, uint32(info.delay/time.Microsecond))
+	}
+	if info.cumulative {
+		flags |= FlagCumulative
+	}
+	return EncodePacket(Header{
+		Type:           PacketAck,
+		Flags:          flags,
+		SequenceNumber: seq,
+		Timestamp:      time.Now(),
+	}, payload)
+}
+
+// appendRanges encodes ranges relative to base: a count (uint8), then per
+// range its start as an offset from base and its length minus one (uint32
+// each)
+func appendRanges(b []byte, base int64, ranges []sackRange) []byte {
+	b = append(b, uint8(len(ranges)))
+	for _, r := range ranges {
+		b = binary.BigEndian.AppendUint32(b, uint32(r.start-base))
+		b = binary.BigEndian.AppendUint32(b, uint32(r.end-r.start))
+	}
+	return b
+}
+
+// parseRanges decodes what appendRanges wrote and returns the rest of b.
+// It reports false if b is truncated.
+func parseRanges(b []byte, base int64) ([]sackRange, []byte, bool) {
+	if len(b) < 1 {
+		return nil, b, false
+	}
+	n := int(b[0])
+	b = b[1:]
+	if len(b) < 8*n {
+		return nil, b, false
+	}
+	ranges := make([]sackRange, n)
+	for i := range ranges {
+		start := base + int64(binary.BigEndian.Uint32(b[8*i:]))
+		ranges[i] = sackRange{start, start + int64(binary.BigEndian.Uint32(b[8*i+4:]))}
+	}
+	return ranges, b[8*n:], true
+}
+
+// encodeNack builds a NACK datagram reporting missing sequence numbers.
+// The header carries the first of them and the payload the ranges, encoded
+// as by appendRanges relative to it.
+func encodeNack(missing []sackRange) []byte {
+	base := missing[0].start
+	return EncodePacket(Header{
+		Type:           PacketNack,
+		SequenceNumber: base,
+		Timestamp:      time.Now(),
+	}, appendRanges(nil, base, missing))
+}
+
+// decodeNack returns the missing ranges a NACK reports
+func decodeNack(h Header, payload []byte) []sackRange {
+	missing, _, _ := parseRanges(payload, h.SequenceNumber)
+	return missing
+}
+
+// encodeResync builds a request to the sender of data packet seq to resend
+// its oldest unacknowledged packet with FlagResync, because the receiver
+// has no state for it
+func encodeResync(seq int64) []byte {
+	return EncodePacket(Header{
+		Type:           PacketResync,
+		SequenceNumber: seq,
+		Timestamp:      time.Now(),
+	}, nil)
+}
+
+// probeDelay is how long a sender facing a zero receive window waits before
+// its next probe: the RTO, doubled for every probe already sent, up to max
+func probeDelay(rto time.Duration, probes int, max time.Duration) time.Duration {
+	d := rto
+	for i := 0; i < probes && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// decodeAck extracts the fields of an ACK's payload. Missing or truncated
+// fields are reported as not advertised.
+func decodeAck(h Header, payload []byte) ackInfo {
+	info := ackInfo{window: -1, cumulative: h.Flags&FlagCumulative != 0}
+	if h.Flags&FlagWindow != 0 {
+		if len(payload) < 4 {
+			return info
+		}
+		info.window = int(binary.BigEndian.Uint32(payload))
+		payload = payload[4:]
+	}
+	if h.Flags&FlagSack != 0 {
+		var ok bool
+		info.sack, payload, ok = parseRanges(payload, h.SequenceNumber)
+		if !ok {
+			return info
+		}
+	}
+	if h.Flags&FlagAckDelay != 0 && len(payload) >= 4 {
+		info.delay = time.Duration(binary.BigEndian.Uint32(payload)) * time.Microsecond
+	}
+	return info
+}
@@ -0,0 +1,153 @@
+package reliable_udp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultAckEvery and DefaultAckDelay are the AckEveryN packet count and the
+// longest time a delaying policy holds back an ACK
+const (
+	DefaultAckEvery = 2
+	DefaultAckDelay = 25 * time.Millisecond
+)
+
+// AckPolicy selects when a receiver acknowledges data packets
+type AckPolicy int
+
+const (
+	// AckImmediate sends one ACK per data packet
+	AckImmediate AckPolicy = iota
+	// AckEveryN sends one cumulative ACK per Config.AckEvery packets, or
+	// Config.AckDelay after the first unacknowledged one
+	AckEveryN
+	// AckDelayed sends one cumulative ACK Config.AckDelay after the first
+	// unacknowledged packet, covering everything that arrived meanwhile
+	AckDelayed
+)
+
+func (p AckPolicy) String() string {
+	switch p {
+	case AckImmediate:
+		return "immediate"
+	case AckEveryN:
+		return "every-n"
+	case AckDelayed:
+		return "delayed"
+	default:
+		return fmt.Sprintf("AckPolicy(%d)", int(p))
+	}
+}
+
+// acknowledge ACKs a data packet from addr according to the ACK policy.
+// ack and result are what accept returned for it. If the packet arrived
+// ahead of a gap and carries FlagNack, a NACK for the missing packets
+// follows the ACK so that the sender can retransmit them without waiting for
+// a timeout. Senders that do not fast retransmit get no NACKs.
+//
+// Under a delaying policy every ACK is cumulative: it names the last
+// in-order packet, carries SACK ranges for anything buffered above it and
+// reports how long the receiver held it back. Out-of-order packets,
+// duplicates and packets arriving while a gap is open are ACKed at once, so
+// that the sender learns about losses without delay.
+func (r *receiverState) acknowledge(addr *net.UDPAddr, h Header, ack int64, result acceptResult) error {
+	r.mu.Lock()
+	peer, ok := r.peers[addr.String()]
+	if !ok {
+		b := encodeAck(ack, r.ackForLocked(addr, h))
+		r.mu.Unlock()
+		return r.writeAck(addr, b)
+	}
+
+	var nack []byte
+	if _, buffered := peer.buffered[h.SequenceNumber]; h.Flags&FlagNack != 0 && (buffered || result == acceptOutOfOrder) {
+		if gaps := peer.newGaps(h.SequenceNumber); len(gaps) > 0 {
+			nack = encodeNack(gaps)
+		}
+	}
+
+	var b []byte
+	switch {
+	case peer.unsynced && peer.next != 0:
+		// Also cover what arrived ahead of the packet that resynced
+		peer.unsynced = false
+		b = r.cumulativeAck(peer)
+	case r.ackPolicy == AckImmediate || r.stopped:
+		b = encodeAck(ack, r.ackForLocked(addr, h))
+	case result != acceptNew || len(peer.buffered) > 0:
+		b = r.cumulativeAck(peer)
+	default:
+		peer.unacked++
+		if peer.unacked == 1 {
+			peer.heldSince = time.Now()
+		}
+		if r.ackPolicy == AckEveryN && peer.unacked >= r.ackEvery {
+			b = r.cumulativeAck(peer)
+		} else if peer.unacked == 1 {
+			if peer.ackTimer == nil {
+				peer.ackTimer = time.AfterFunc(r.ackDelay, func() { r.flushAck(addr, peer) })
+			} else {
+				peer.ackTimer.Reset(r.ackDelay)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	if b != nil {
+		if err := r.writeAck(addr, b); err != nil {
+			return err
+		}
+	}
+	if nack != nil {
+		return r.write(addr, nack)
+	}
+	return nil
+}
+
+// flushAck sends peer's held-back ACK when its delay timer fires
+func (r *receiverState) flushAck(addr *net.UDPAddr, peer *peerState) {
+	r.mu.Lock()
+	if peer.unacked == 0 || r.peers[addr.String()] != peer {
+		r.mu.Unlock()
+		return
+	}
+	b := r.cumulativeAck(peer)
+	r.mu.Unlock()
+	r.writeAck(addr, b)
+}
+
+// cumulativeAck builds a cumulative ACK for everything received from peer
+// and clears its pending count. The delay it reports is how long the oldest
+// packet the policy held back waited for it, at most AckDelay; an ACK that
+// held nothing back reports none. Caller must hold r.mu.
+func (r *receiverState) cumulativeAck(peer *peerState) []byte {
+	var delay time.Duration
+	if peer.unacked > 0 {
+		if delay = time.Since(peer.heldSince); delay > r.ackDelay {
+			delay = r.ackDelay
+		}
+	}
+	peer.unacked = 0
+	if peer.ackTimer != nil {
+		peer.ackTimer.Stop()
+	}
+
+	ack := peer.next - 1
+	if ack < 0 {
+		ack = 0
+	}
+	info := ackInfo{
+		window:     r.windowLocked(),
+		sack:       peer.sackRanges(),
+		cumulative: true,
+		delay:      delay,
+	}
+	return encodeAck(ack, info)
+}
+
+// writeAck sends an ACK datagram to addr and counts it
+func (r *receiverState) writeAck(addr *net.UDPAddr, b []byte) error {
+	r.stats.add(func(s *Statistics) { s.acksSent++ })
+	return r.write(addr, b)
+}
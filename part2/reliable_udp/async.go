@@ -0,0 +1,269 @@
+package reliable_udp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// SendHandle tracks a message queued with SendAsync
+type SendHandle struct {
+	done chan struct{}
+
+	mu        sync.Mutex
+	rtt       time.Duration
+	err       error
+	callbacks []func(time.Duration, error)
+}
+
+func newSendHandle() *SendHandle {
+	return &SendHandle{done: make(chan struct{})}
+}
+
+// Done returns a channel that is closed once the message was acknowledged
+// or given up on
+func (h *SendHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the send completes and returns the time from the first
+// transmission to the last ACK, or the error that ended it
+func (h *SendHandle) Wait() (time.Duration, error) {
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt, h.err
+}
+
+// OnComplete registers fn to be called with the send's result. If the send
+// already completed, fn runs immediately; otherwise it runs on the goroutine
+// that completes the send, such as the socket's ACK reader, and must not
+// block.
+func (h *SendHandle) OnComplete(fn func(rtt time.Duration, err error)) {
+	h.mu.Lock()
+	select {
+	case <-h.done:
+		rtt, err := h.rtt, h.err
+		h.mu.Unlock()
+		fn(rtt, err)
+	default:
+		h.callbacks = append(h.callbacks, fn)
+		h.mu.Unlock()
+	}
+}
+
+// complete records the result, wakes waiters and runs the callbacks
+func (h *SendHandle) complete(rtt time.Duration, err error) {
+	h.mu.Lock()
+	h.rtt, h.err = rtt, err
+	callbacks := h.callbacks
+	h.callbacks = nil
+	close(h.done)
+	h.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(rtt, err)
+	}
+}
+
+// asyncSend is a message waiting in a socket's send queue
+type asyncSend struct {
+	ctx    context.Context
+	data   string
+	policy RetryPolicy
+	handle *SendHandle
+}
+
+// SendAsync queues data for reliable delivery on conn and returns
+// immediately. Messages queued on the same socket are sent in order by a
+// single background goroutine, which keeps up to Config.WindowSize packets
+// of them in flight with the retransmission strategy of Config.Mode.
+// Meanwhile a second goroutine reads the ACKs from conn, so conn must not be
+// read by anything else until the handles are done. Both exit when the
+// queue is empty.
+func SendAsync(conn *net.UDPConn, data string) *SendHandle {
+	cfg := endpointFor(conn).settings()
+	return sendAsync(context.Background(), conn, data, cfg.RetryPolicy)
+}
+
+// SendAsyncContext is like SendAsync but gives up on the message once ctx
+// is done, whether it is still queued or already being retried. Its packets
+// are then no longer retransmitted and the receiver skips over them.
+func SendAsyncContext(ctx context.Context, conn *net.UDPConn, data string) *SendHandle {
+	cfg := endpointFor(conn).settings()
+	return sendAsync(ctx, conn, data, cfg.RetryPolicy)
+}
+
+func sendAsync(ctx context.Context, conn *net.UDPConn, data string, policy RetryPolicy) *SendHandle {
+	h := newSendHandle()
+	ep := endpointFor(conn)
+
+	ep.queueMu.Lock()
+	defer ep.queueMu.Unlock()
+
+	ep.queue = append(ep.queue, &asyncSend{ctx: ctx, data: data, policy: policy, handle: h})
+	ep.pending++
+	if !ep.sending {
+		ep.sending = true
+		go ep.drain(conn)
+	}
+	if !ep.reading {
+		ep.reading = true
+		go ep.readAcks(conn)
+	}
+	return h
+}
+
+// drain moves queued messages into the send window until the queue is
+// empty. It only blocks while the window is full.
+func (ep *endpoint) drain(conn *net.UDPConn) {
+	for {
+		ep.queueMu.Lock()
+		if len(ep.queue) == 0 {
+			ep.sending = false
+			ep.queueMu.Unlock()
+			return
+		}
+		s := ep.queue[0]
+		ep.queue[0] = nil
+		ep.queue = ep.queue[1:]
+		w := ep.sendWindow(conn)
+		ep.queueMu.Unlock()
+
+		if err := contextErr(s.ctx); err != nil {
+			ep.complete(conn, s.handle, 0, fmt.Errorf("send abandoned: %w", err))
+			continue
+		}
+
+		m := &windowMessage{done: func(rtt time.Duration, err error) {
+			if errors.Is(err, errSendCanceled) {
+				err = fmt.Errorf("send abandoned: %w", s.ctx.Err())
+			}
+			ep.complete(conn, s.handle, rtt, err)
+		}}
+		if done := s.ctx.Done(); done != nil {
+			go func() {
+				select {
+				case <-done:
+					w.abandon(m, s.ctx.Err())
+				case <-s.handle.Done():
+				}
+			}()
+		}
+		// The outcome is reported through m
+		w.sendMessage([]byte(s.data), 0, s.policy, s.ctx.Done(), m)
+	}
+}
+
+// sendWindow returns the window queued messages are sent with, starting a
+// new one with the current settings if there is none, the last one failed
+// or Configure replaced the settings. Caller must hold ep.queueMu.
+func (ep *endpoint) sendWindow(conn *net.UDPConn) *sendWindow {
+	if ep.window != nil && !ep.window.failed() {
+		return ep.window
+	}
+	cfg := ep.settings()
+	write := func(b []byte) error {
+		_, err := conn.Write(ep.crypto.Load().seal(b, cfg.Checksum))
+		return err
+	}
+	nextSeq := func() int64 { return ep.seq.Add(1) }
+	ep.window = newSendWindow(cfg, ep.stats, write, nextSeq, true)
+	return ep.window
+}
+
+// complete reports the outcome of a queued message and stops the ACK
+// reader once nothing is pending
+func (ep *endpoint) complete(conn *net.UDPConn, h *SendHandle, rtt time.Duration, err error) {
+	ep.queueMu.Lock()
+	ep.pending--
+	if ep.pending == 0 {
+		if ep.reconfigure {
+			ep.window = nil
+			ep.reconfigure = false
+		}
+		// Wake the reader so that it exits
+		conn.SetReadDeadline(time.Now())
+	}
+	ep.queueMu.Unlock()
+
+	h.complete(rtt, err)
+}
+
+// readErrorBackoff is the first pause of the ACK reader after a read error;
+// it doubles with every further error in a row up to maxReadErrorBackoff
+const (
+	readErrorBackoff    = 10 * time.Millisecond
+	maxReadErrorBackoff = time.Second
+)
+
+// readAcks hands the ACKs arriving on conn to the send window while
+// messages are pending. Other datagrams are dropped. It stops once conn is
+// closed and waits a little longer after each other read error in a row.
+func (ep *endpoint) readAcks(conn *net.UDPConn) {
+	buf := make([]byte, maxDatagramSize)
+	var backoff time.Duration
+	for {
+		n, _, err := conn.ReadFrom(buf)
+
+		ep.queueMu.Lock()
+		closed := errors.Is(err, net.ErrClosed)
+		if ep.pending == 0 || closed {
+			ep.reading = false
+			conn.SetReadDeadline(time.Time{})
+		}
+		if ep.pending == 0 {
+			ep.queueMu.Unlock()
+			return
+		}
+		w := ep.window
+		if err != nil && !closed {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// Woken for a queue that has filled up again
+				conn.SetReadDeadline(time.Time{})
+				ep.queueMu.Unlock()
+				continue
+			}
+		}
+		ep.queueMu.Unlock()
+
+		if err != nil {
+			if w != nil {
+				w.mu.Lock()
+				w.fail(fmt.Errorf("read error: %v", err))
+				w.unlock()
+			}
+			if closed {
+				return
+			}
+			if backoff < readErrorBackoff {
+				backoff = readErrorBackoff
+			} else if backoff < maxReadErrorBackoff {
+				backoff *= 2
+			}
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		if w == nil {
+			continue
+		}
+
+		header, payload, err := decodeReceived(buf[:n], w.cfg.Checksum, ep.stats, ep.crypto.Load())
+		if err != nil {
+			continue
+		}
+		switch header.Type {
+		case PacketAck:
+			w.handleAck(header.SequenceNumber, decodeAck(header, payload))
+		case PacketNack:
+			w.handleNack(decodeNack(header, payload))
+		case PacketResync:
+			w.handleResync(header.SequenceNumber)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package reliable_udp
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Batched I/O
+//
+// With Config.BatchSize above one, sockets are read with recvmmsg and
+// written with sendmmsg through golang.org/x/net, moving up to BatchSize
+// datagrams per system call. Writes are queued and sent by a background
+// goroutine, which takes everything queued since its last system call, so
+// packets sent in a burst share one: a window of data, or the ACKs for a
+// batch just read. A datagram the kernel refuses is retried on its own and
+// dropped if that fails too, like a loss on the path; the error is passed
+// to refused, so that path MTU discovery still learns of EMSGSIZE.
+//
+// Where batching is not available, with a BatchSize of zero or one, or once
+// the kernel turns out not to implement the calls, every datagram takes its
+// own system call.
+
+const (
+	// MaxBatchSize is the most datagrams moved by one system call
+	MaxBatchSize = 64
+
+	// batchQueue is how many datagrams per BatchSize may wait to be
+	// written before writers block
+	batchQueue = 4
+)
+
+// batchMessages moves several datagrams per system call. ipv4.Message and
+// ipv6.Message are the same type, so both packet conns implement it.
+type batchMessages interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchConn reads and writes a UDP socket, batching system calls if
+// enabled. Only one goroutine may read.
+type batchConn struct {
+	sock      *net.UDPConn
+	connected bool          // sock is dialed; datagrams carry no address
+	v6        bool          // sock is IPv6, which batches only to IPv6 peers
+	mmsg      batchMessages // nil for per-packet I/O
+
+	ms      []ipv4.Message // read batch
+	readOne bool           // recvmmsg is not implemented
+
+	queue     chan ipv4.Message // nil for per-packet writes
+	done      chan struct{}
+	flushed   chan struct{} // closed once the queue is written out
+	closeOnce sync.Once
+
+	// refused is told about queued datagrams that could not be sent. It
+	// must be set before the first write.
+	refused func(p []byte, addr *net.UDPAddr, err error)
+}
+
+// newBatchConn wraps sock for I/O of up to size datagrams per system call
+func newBatchConn(sock *net.UDPConn, size int) *batchConn {
+	b := &batchConn{
+		sock:      sock,
+		connected: sock.RemoteAddr() != nil,
+	}
+	if size > 1 {
+		b.mmsg = newBatchMessages(sock)
+	}
+	if b.mmsg == nil {
+		size = 1
+	}
+	if local, ok := sock.LocalAddr().(*net.UDPAddr); ok {
+		b.v6 = local.IP.To4() == nil
+	}
+
+	b.ms = make([]ipv4.Message, size)
+	for i := range b.ms {
+		b.ms[i].Buffers = [][]byte{make([]byte, maxDatagramSize)}
+	}
+	if b.mmsg != nil {
+		b.queue = make(chan ipv4.Message, batchQueue*size)
+		b.done = make(chan struct{})
+		b.flushed = make(chan struct{})
+		go b.flushLoop(size)
+	}
+	return b
+}
+
+// read waits for datagrams and returns them, at least one. Each holds its
+// bytes in Buffers[0][:N] and its sender in Addr, a *net.UDPAddr. They are
+// overwritten by the next read.
+func (b *batchConn) read() ([]ipv4.Message, error) {
+	if b.mmsg != nil && !b.readOne {
+		n, err := b.mmsg.ReadBatch(b.ms, 0)
+		if err == nil {
+			return b.ms[:n], nil
+		}
+		if !isBatchUnsupported(err) {
+			return nil, err
+		}
+		b.readOne = true
+	}
+
+	n, addr, err := b.sock.ReadFromUDP(b.ms[0].Buffers[0])
+	if err != nil {
+		return nil, err
+	}
+	b.ms[0].N, b.ms[0].Addr = n, addr
+	return b.ms[:1], nil
+}
+
+// write sends p to addr, which is ignored on a connected socket. With
+// batching, p is queued and must not be modified afterwards, and errors
+// other than a closed batchConn are passed to refused instead.
+func (b *batchConn) write(p []byte, addr *net.UDPAddr) error {
+	if b.queue == nil || !b.connected && b.v6 && addr.IP.To4() != nil {
+		// x/net addresses IPv4 peers in a way IPv6 sockets reject
+		return b.writeOne(p, addr)
+	}
+
+	m := ipv4.Message{Buffers: [][]byte{p}}
+	if !b.connected {
+		m.Addr = addr
+	}
+	select {
+	case b.queue <- m:
+		return nil
+	case <-b.done:
+		return net.ErrClosed
+	}
+}
+
+// writeOne sends p to addr with a system call of its own
+func (b *batchConn) writeOne(p []byte, addr *net.UDPAddr) error {
+	var err error
+	if b.connected {
+		_, err = b.sock.Write(p)
+	} else {
+		_, err = b.sock.WriteToUDP(p, addr)
+	}
+	return err
+}
+
+// flushLoop writes queued datagrams, up to size per system call, until the
+// batchConn is closed
+func (b *batchConn) flushLoop(size int) {
+	defer close(b.flushed)
+
+	ms := make([]ipv4.Message, 0, size)
+	writeOne := false
+	for {
+		select {
+		case m := <-b.queue:
+			ms = b.gather(append(ms[:0], m))
+		case <-b.done:
+			// Send what was queued before the socket closes
+			for ms = b.gather(ms[:0]); len(ms) > 0; ms = b.gather(ms[:0]) {
+				writeOne = b.writeBatch(ms, writeOne)
+			}
+			return
+		}
+		writeOne = b.writeBatch(ms, writeOne)
+	}
+}
+
+// gather adds queued datagrams to ms, without waiting, until it is full
+func (b *batchConn) gather(ms []ipv4.Message) []ipv4.Message {
+	for len(ms) < cap(ms) {
+		select {
+		case m := <-b.queue:
+			ms = append(ms, m)
+		default:
+			return ms
+		}
+	}
+	return ms
+}
+
+// writeBatch sends ms, one datagram per system call if writeOne is set or
+// sendmmsg turns out not to be implemented. It returns whether later
+// batches should be sent that way.
+func (b *batchConn) writeBatch(ms []ipv4.Message, writeOne bool) bool {
+	for len(ms) > 0 {
+		if !writeOne {
+			n, err := b.mmsg.WriteBatch(ms, 0)
+			if err == nil {
+				ms = ms[n:]
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return writeOne
+			}
+			writeOne = isBatchUnsupported(err)
+		}
+
+		// The first datagram failed, or batching is off: send it alone
+		addr, _ := ms[0].Addr.(*net.UDPAddr)
+		err := b.writeOne(ms[0].Buffers[0], addr)
+		if errors.Is(err, net.ErrClosed) {
+			return writeOne
+		}
+		if err != nil && b.refused != nil {
+			// Its own goroutine, since the owner may hold a lock while it
+			// waits for room in the queue
+			go b.refused(ms[0].Buffers[0], addr, err)
+		}
+		ms = ms[1:]
+	}
+	return writeOne
+}
+
+// close writes out the queued datagrams and stops the writer. The socket
+// itself is left open.
+func (b *batchConn) close() {
+	if b.queue == nil {
+		return
+	}
+	b.closeOnce.Do(func() {
+		close(b.done)
+		<-b.flushed
+	})
+}
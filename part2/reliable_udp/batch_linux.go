@@ -0,0 +1,24 @@
+package reliable_udp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// newBatchMessages returns recvmmsg and sendmmsg access to sock
+func newBatchMessages(sock *net.UDPConn) batchMessages {
+	if local, ok := sock.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() == nil {
+		return ipv6.NewPacketConn(sock)
+	}
+	return ipv4.NewPacketConn(sock)
+}
+
+// isBatchUnsupported reports whether a batched read or write failed because
+// the kernel does not implement it
+func isBatchUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOSYS)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package reliable_udp
+
+import "net"
+
+// newBatchMessages returns nil: x/net only batches on Linux, and moves one
+// datagram per call elsewhere
+func newBatchMessages(sock *net.UDPConn) batchMessages {
+	return nil
+}
+
+// isBatchUnsupported is never called, since nothing is batched
+func isBatchUnsupported(err error) bool {
+	return false
+}
@@ -0,0 +1,151 @@
+package reliable_udp
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultMinCompressSize is the smallest message compressed by default
+const DefaultMinCompressSize = 128
+
+// FlateCompressorID identifies NewFlateCompressor's compressor in the
+// handshake. Custom compressors should use IDs from 128 on.
+const FlateCompressorID uint8 = 1
+
+// Compressor compresses the messages of a connection. Its ID names the
+// algorithm when the two ends negotiate one in the handshake.
+type Compressor interface {
+	ID() uint8
+	Compress(src []byte) ([]byte, error)
+	// Decompress fails rather than return more than max bytes
+	Decompress(src []byte, max int) ([]byte, error)
+}
+
+// flateCompressor is DEFLATE with reused writers
+type flateCompressor struct {
+	level   int
+	writers sync.Pool // *flate.Writer
+}
+
+// NewFlateCompressor returns a DEFLATE compressor using the given
+// compress/flate level
+func NewFlateCompressor(level int) Compressor {
+	return &flateCompressor{level: level}
+}
+
+func (f *flateCompressor) ID() uint8 {
+	return FlateCompressorID
+}
+
+func (f *flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := f.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, f.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer f.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *flateCompressor) Decompress(src []byte, max int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, fmt.Errorf("decompressed message exceeds %d bytes", max)
+	}
+	return out, nil
+}
+
+// appendOffer appends the IDs of compressors to a SYN or SYN-ACK payload:
+// their count, then one byte each
+func appendOffer(b []byte, compressors []Compressor) []byte {
+	if len(compressors) == 0 {
+		return b
+	}
+	b = append(b, byte(len(compressors)))
+	for _, c := range compressors {
+		b = append(b, c.ID())
+	}
+	return b
+}
+
+// parseOffer returns the compressor IDs at the end of a SYN or SYN-ACK
+// payload. Peers that offer none send nothing.
+func parseOffer(b []byte) []uint8 {
+	if len(b) == 0 || int(b[0]) != len(b)-1 {
+		return nil
+	}
+	return b[1:]
+}
+
+// chooseCompressor returns the first of ours that the peer offered
+func chooseCompressor(ours []Compressor, offered []uint8) Compressor {
+	for _, c := range ours {
+		if bytes.IndexByte(offered, c.ID()) >= 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// compress compresses a message with the negotiated compressor, unless it
+// is shorter than MinCompressSize or compression saves less than a
+// sixteenth of it. It returns the flags for the message's packets.
+func (c *Conn) compress(data []byte) ([]byte, uint16) {
+	if c.compressor == nil {
+		return data, 0
+	}
+	if len(data) < c.cfg.MinCompressSize {
+		c.stats.onCompressionSkipped(0)
+		return data, 0
+	}
+
+	start := time.Now()
+	out, err := c.compressor.Compress(data)
+	elapsed := time.Since(start)
+	if err != nil || len(out) > len(data)-len(data)/16 {
+		c.stats.onCompressionSkipped(elapsed)
+		return data, 0
+	}
+	c.stats.onCompressed(len(data), len(out), elapsed)
+	return out, FlagCompressed
+}
+
+// decompress returns the message of a delivery
+func (c *Conn) decompress(d delivery) ([]byte, error) {
+	if !d.compressed {
+		return d.data, nil
+	}
+	if c.compressor == nil {
+		return nil, fmt.Errorf("compressed message without a negotiated compressor")
+	}
+
+	start := time.Now()
+	data, err := c.compressor.Decompress(d.data, MaxMessageSize)
+	c.stats.onDecompressed(time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("decompress error: %v", err)
+	}
+	return data, nil
+}
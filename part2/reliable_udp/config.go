@@ -0,0 +1,263 @@
+package reliable_udp
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultWindowSize = 32
+	MaxWindowSize     = ReorderBufferSize
+	DefaultMinRTO     = 200 * time.Millisecond
+	DefaultMaxRTO     = 2 * time.Second
+
+	DefaultHandshakeTimeout = 5 * time.Second
+	DefaultMaxPending       = 256
+	DefaultLinger           = 5 * time.Second
+	DefaultIdleTimeout      = 30 * time.Second
+	DefaultMaxSessions      = 4096
+
+	DefaultReceiveWindow = 4 << 20
+
+	DefaultRekeyPackets = 1 << 20
+	DefaultRekeyBytes   = 1 << 30
+
+	DefaultPMTUProbeInterval = 10 * time.Minute
+)
+
+// Mode selects the retransmission strategy of a connection
+type Mode int
+
+const (
+	// ModeSelectiveRepeat ACKs every packet and resends only the lost ones
+	ModeSelectiveRepeat Mode = iota
+	// ModeGoBackN uses cumulative ACKs and resends everything from the
+	// first unacknowledged packet on timeout
+	ModeGoBackN
+	// ModeStopAndWait keeps a single packet in flight, like SendReliable
+	ModeStopAndWait
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeSelectiveRepeat:
+		return "selective-repeat"
+	case ModeGoBackN:
+		return "go-back-n"
+	case ModeStopAndWait:
+		return "stop-and-wait"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// Config holds the per-connection transmission settings
+type Config struct {
+	// Mode is the retransmission strategy
+	Mode Mode
+	// WindowSize is the number of packets kept in flight (1..MaxWindowSize).
+	// It is ignored in ModeStopAndWait.
+	WindowSize int
+	// MinRTO and MaxRTO clamp the adaptive retransmission timeout
+	MinRTO time.Duration
+	MaxRTO time.Duration
+	// RetryPolicy controls backoff between retransmissions and when to
+	// give up on a packet
+	RetryPolicy RetryPolicy
+
+	// Congestion selects the congestion control algorithm, which limits the
+	// window below WindowSize and may pace packets
+	Congestion Congestion
+	// NewCongestionController, if set, creates a custom controller for each
+	// sender and overrides Congestion
+	NewCongestionController func() CongestionController
+	// TraceCwnd records every congestion window change for plotting
+	TraceCwnd bool
+
+	// FastRetransmit resends packets as soon as the receiver reports them
+	// missing in a NACK, instead of waiting for their retransmit timer
+	FastRetransmit bool
+
+	// SACK makes a ModeGoBackN receiver buffer out-of-order packets and
+	// report them in its cumulative ACKs, so that the sender retransmits
+	// only the missing ones. It is ignored in the other modes.
+	SACK bool
+
+	// ReceiveWindow is the receive buffer, in bytes, for messages that
+	// arrived but were not read yet. Its free space is advertised in every
+	// ACK and senders keep no more unacknowledged data in flight than that.
+	ReceiveWindow int
+
+	// AckPolicy selects when the receiving side sends ACKs. AckEvery is the
+	// packet count for AckEveryN, and AckDelay the longest an ACK is held
+	// back by AckEveryN or AckDelayed.
+	AckPolicy AckPolicy
+	AckEvery  int
+	AckDelay  time.Duration
+
+	// Checksum is the integrity check carried in every packet header. Both
+	// ends must use the same one; the zero value is CRC32C.
+	Checksum Checksum
+
+	// Cipher encrypts and authenticates every packet with Key, a KeySize
+	// byte pre-shared key, and discards replayed packets. Both ends must
+	// use the same cipher and key.
+	Cipher Cipher
+	Key    []byte
+
+	// KeyExchange makes Dial and Listen run an ephemeral X25519 exchange in
+	// the handshake and encrypt the connection with Cipher under keys
+	// derived from it, so that recorded traffic stays secret even if Key or
+	// Identity leak later. The exchange is authenticated by Key, by
+	// Identity, or by both.
+	KeyExchange bool
+	// Identity is this side's long-term Ed25519 key, which signs its half of
+	// the key exchange. The peer's must be one of TrustedPeers.
+	Identity     ed25519.PrivateKey
+	TrustedPeers []ed25519.PublicKey
+	// RekeyPackets and RekeyBytes bound how many packets and payload bytes a
+	// session key protects before the next one is derived from it
+	RekeyPackets int64
+	RekeyBytes   int64
+
+	// Compressors are the compression algorithms Dial and Listen offer in
+	// the handshake, most preferred first. The listener picks the first of
+	// its own that the dialer offered. Messages of at least MinCompressSize
+	// bytes are then compressed with it, unless that barely shrinks them.
+	Compressors     []Compressor
+	MinCompressSize int
+
+	// FECGroup makes senders follow every FECGroup data packets with an XOR
+	// parity packet, from which the receiver rebuilds any one packet of the
+	// group that was lost without waiting for a retransmission. Zero
+	// disables FEC; values above MaxFECGroup are clamped.
+	FECGroup int
+
+	// PathMTUDiscovery sets the DF bit on the socket and probes for the
+	// largest datagram that reaches the peer, so that messages are cut into
+	// packets of that size instead of MaxPacketSize. The search is repeated
+	// every PMTUProbeInterval. It needs Linux; elsewhere packets stay at
+	// MaxPacketSize.
+	PathMTUDiscovery  bool
+	PMTUProbeInterval time.Duration
+
+	// BatchSize makes Dial, Listen, NewServer and NewWindowSender read and
+	// write up to BatchSize datagrams per system call with recvmmsg and
+	// sendmmsg. Writes are then queued and sent from a background
+	// goroutine, so a write that fails is noticed only as a lost packet,
+	// except by path MTU discovery. It needs Linux; elsewhere, and with
+	// zero or one, every datagram takes its own system call. Values above
+	// MaxBatchSize are clamped.
+	BatchSize int
+
+	// HandshakeTimeout bounds connection setup in Dial and how long a
+	// listener keeps a half-open connection that never completes it
+	HandshakeTimeout time.Duration
+	// MaxPending bounds the half-open connections a listener keeps; SYNs
+	// beyond it are dropped until handshakes complete or time out
+	MaxPending int
+	// Linger is how long Conn.Close waits for unacknowledged data before
+	// resetting the connection
+	Linger time.Duration
+	// IdleTimeout closes a connection that has heard nothing from its peer
+	// for this long; keepalives are sent after a third of it. Servers reap
+	// idle sessions and ReceiveReliable forgets idle senders after it too.
+	// Negative disables keepalives and the timeout.
+	IdleTimeout time.Duration
+	// MaxSessions bounds the sessions a Server keeps; packets from further
+	// peers are dropped until a session is closed or reaped
+	MaxSessions int
+}
+
+// DefaultConfig returns the settings used when none are given
+func DefaultConfig() Config {
+	return Config{
+		WindowSize:  DefaultWindowSize,
+		MinRTO:      DefaultMinRTO,
+		MaxRTO:      DefaultMaxRTO,
+		RetryPolicy: DefaultRetryPolicy(),
+
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		MaxPending:       DefaultMaxPending,
+		Linger:           DefaultLinger,
+		IdleTimeout:      DefaultIdleTimeout,
+		MaxSessions:      DefaultMaxSessions,
+
+		ReceiveWindow: DefaultReceiveWindow,
+		AckEvery:      DefaultAckEvery,
+		AckDelay:      DefaultAckDelay,
+	}
+}
+
+// normalize fills in defaults and clamps out-of-range values
+func (c Config) normalize() Config {
+	if c.WindowSize <= 0 {
+		c.WindowSize = DefaultWindowSize
+	}
+	if c.WindowSize > MaxWindowSize {
+		c.WindowSize = MaxWindowSize
+	}
+	if c.MinRTO <= 0 {
+		c.MinRTO = DefaultMinRTO
+	}
+	if c.MaxRTO <= 0 {
+		c.MaxRTO = DefaultMaxRTO
+	}
+	if c.MaxRTO < c.MinRTO {
+		c.MaxRTO = c.MinRTO
+	}
+	c.RetryPolicy = c.RetryPolicy.normalize(c.MaxRTO)
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if c.MaxPending <= 0 {
+		c.MaxPending = DefaultMaxPending
+	}
+	if c.Linger <= 0 {
+		c.Linger = DefaultLinger
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultIdleTimeout
+	}
+	if c.MaxSessions <= 0 {
+		c.MaxSessions = DefaultMaxSessions
+	}
+	if c.ReceiveWindow <= 0 {
+		c.ReceiveWindow = DefaultReceiveWindow
+	}
+	if c.MinCompressSize <= 0 {
+		c.MinCompressSize = DefaultMinCompressSize
+	}
+	if c.PMTUProbeInterval <= 0 {
+		c.PMTUProbeInterval = DefaultPMTUProbeInterval
+	}
+	if c.FECGroup < 0 {
+		c.FECGroup = 0
+	}
+	if c.FECGroup > MaxFECGroup {
+		c.FECGroup = MaxFECGroup
+	}
+	if c.BatchSize < 0 {
+		c.BatchSize = 0
+	}
+	if c.BatchSize > MaxBatchSize {
+		c.BatchSize = MaxBatchSize
+	}
+	if c.RekeyPackets <= 0 {
+		c.RekeyPackets = DefaultRekeyPackets
+	}
+	if c.RekeyBytes <= 0 {
+		c.RekeyBytes = DefaultRekeyBytes
+	}
+	if c.AckEvery <= 0 {
+		c.AckEvery = DefaultAckEvery
+	}
+	if c.AckDelay <= 0 {
+		c.AckDelay = DefaultAckDelay
+	}
+	if c.Mode == ModeStopAndWait {
+		c.WindowSize = 1
+	}
+	return c
+}
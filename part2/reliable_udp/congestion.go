@@ -0,0 +1,393 @@
+package reliable_udp
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// InitialCwnd is the congestion window, in packets, before any feedback
+const InitialCwnd = 10
+
+// minCwnd is the smallest window a controller reduces to
+const minCwnd = 2
+
+// Congestion selects the congestion control algorithm of a connection
+type Congestion int
+
+const (
+	// CongestionNone keeps Config.WindowSize packets in flight regardless
+	// of loss
+	CongestionNone Congestion = iota
+	// CongestionReno grows the window by one packet per RTT and halves it
+	// on loss (AIMD), with slow start below the threshold
+	CongestionReno
+	// CongestionCubic grows the window along a cubic curve around the size
+	// at the last loss, as in RFC 8312
+	CongestionCubic
+	// CongestionBBR sizes the window and pacing rate from the measured
+	// bottleneck bandwidth and minimum RTT, ignoring loss
+	CongestionBBR
+)
+
+func (c Congestion) String() string {
+	switch c {
+	case CongestionNone:
+		return "none"
+	case CongestionReno:
+		return "reno"
+	case CongestionCubic:
+		return "cubic"
+	case CongestionBBR:
+		return "bbr"
+	default:
+		return fmt.Sprintf("Congestion(%d)", int(c))
+	}
+}
+
+// AckEvent describes a newly acknowledged packet
+type AckEvent struct {
+	Now    time.Time
+	SentAt time.Time
+	Bytes  int // size on the wire, header included
+	// RTT is the packet's round-trip time, or 0 if it was retransmitted and
+	// the sample is ambiguous
+	RTT time.Duration
+	// DeliveryRate is the wire bytes acknowledged per second between this
+	// packet's transmission and its ACK
+	DeliveryRate float64
+	// Inflight is the number of packets still unacknowledged
+	Inflight int
+	// AppLimited is set when the sender did not fill the congestion window:
+	// fewer packets were in flight and no more were waiting to be sent, or
+	// the window already admits Config.WindowSize packets. Loss-based
+	// controllers do not grow the window on such ACKs.
+	AppLimited bool
+}
+
+// LossEvent describes a packet whose retransmit timer expired
+type LossEvent struct {
+	Now      time.Time
+	SentAt   time.Time
+	Inflight int
+}
+
+// CongestionController decides how many packets a sender may keep in flight
+// and how fast it may send them. The sender calls it with its lock held, so
+// implementations need no locking of their own but must not block.
+type CongestionController interface {
+	OnAck(ev AckEvent)
+	OnLoss(ev LossEvent)
+	// Window returns the congestion window in packets. The sender never
+	// exceeds Config.WindowSize either.
+	Window() int
+	// PacingRate returns the rate in wire bytes per second at which
+	// packets should be spaced, or 0 to send as fast as the window allows
+	PacingRate() float64
+}
+
+// newCongestionController returns the controller cfg selects, or nil
+func newCongestionController(cfg Config) CongestionController {
+	if cfg.NewCongestionController != nil {
+		return cfg.NewCongestionController()
+	}
+	switch cfg.Congestion {
+	case CongestionReno:
+		return NewReno()
+	case CongestionCubic:
+		return NewCubic()
+	case CongestionBBR:
+		return NewBBR()
+	default:
+		return nil
+	}
+}
+
+// Reno is AIMD congestion control with slow start
+type Reno struct {
+	cwnd     float64
+	ssthresh float64
+	recovery time.Time // losses of packets sent before this were already handled
+}
+
+// NewReno returns a Reno controller in slow start
+func NewReno() *Reno {
+	return &Reno{cwnd: InitialCwnd, ssthresh: math.Inf(1)}
+}
+
+func (r *Reno) OnAck(ev AckEvent) {
+	if ev.AppLimited {
+		return
+	}
+	if r.cwnd < r.ssthresh {
+		r.cwnd++
+	} else {
+		r.cwnd += 1 / r.cwnd
+	}
+}
+
+func (r *Reno) OnLoss(ev LossEvent) {
+	// React once per window of data, not once per lost packet
+	if !ev.SentAt.After(r.recovery) {
+		return
+	}
+	r.recovery = ev.Now
+	r.ssthresh = math.Max(r.cwnd/2, minCwnd)
+	r.cwnd = r.ssthresh
+}
+
+func (r *Reno) Window() int {
+	return int(r.cwnd)
+}
+
+func (r *Reno) PacingRate() float64 {
+	return 0
+}
+
+// CUBIC constants from RFC 8312
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// Cubic is CUBIC congestion control (RFC 8312) with its TCP-friendly region
+type Cubic struct {
+	cwnd     float64
+	ssthresh float64
+	wMax     float64 // window before the last reduction
+	k        float64 // seconds until the cubic curve reaches wMax
+	epoch    time.Time
+	wEst     float64 // window standard AIMD would have
+	minRTT   time.Duration
+	recovery time.Time
+}
+
+// NewCubic returns a CUBIC controller in slow start
+func NewCubic() *Cubic {
+	return &Cubic{cwnd: InitialCwnd, ssthresh: math.Inf(1)}
+}
+
+func (c *Cubic) OnAck(ev AckEvent) {
+	if ev.RTT > 0 && (c.minRTT == 0 || ev.RTT < c.minRTT) {
+		c.minRTT = ev.RTT
+	}
+	if ev.AppLimited {
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd++
+		return
+	}
+
+	if c.epoch.IsZero() {
+		c.epoch = ev.Now
+		if c.cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / cubicC)
+		} else {
+			c.k = 0
+			c.wMax = c.cwnd
+		}
+		c.wEst = c.cwnd
+	}
+
+	t := ev.Now.Sub(c.epoch).Seconds() + c.minRTT.Seconds()
+	target := c.wMax + cubicC*math.Pow(t-c.k, 3)
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) / c.cwnd
+	} else {
+		c.cwnd += 0.01 / c.cwnd
+	}
+
+	// Never grow slower than Reno would
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) / c.cwnd
+	if c.wEst > c.cwnd {
+		c.cwnd = c.wEst
+	}
+}
+
+func (c *Cubic) OnLoss(ev LossEvent) {
+	if !ev.SentAt.After(c.recovery) {
+		return
+	}
+	c.recovery = ev.Now
+	c.epoch = time.Time{}
+	c.wMax = c.cwnd
+	c.cwnd = math.Max(c.cwnd*cubicBeta, minCwnd)
+	c.ssthresh = c.cwnd
+}
+
+func (c *Cubic) Window() int {
+	return int(c.cwnd)
+}
+
+func (c *Cubic) PacingRate() float64 {
+	return 0
+}
+
+// BBR phases
+type bbrState int
+
+const (
+	bbrStartup bbrState = iota
+	bbrDrain
+	bbrProbeBW
+)
+
+// BBR parameters
+const (
+	bbrHighGain      = 2.885 // 2/ln(2): doubles the sending rate every round
+	bbrCwndGain      = 2
+	bbrBwWindow      = 10 // rounds over which the bandwidth maximum is kept
+	bbrRTpropWindow  = 10 * time.Second
+	bbrFullBwRounds  = 3
+	bbrFullBwGrowth  = 1.25
+	bbrMinPipeWindow = 4
+)
+
+// bbrProbeGains is the pacing gain cycle of ProbeBW, one phase per round
+var bbrProbeGains = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// BBR is a simplified model-based controller after BBRv1. It estimates the
+// bottleneck bandwidth as the maximum delivery rate over recent rounds and
+// the propagation delay as the minimum RTT, paces at gain * bandwidth and
+// caps the window at twice the bandwidth-delay product. It has Startup,
+// Drain and ProbeBW phases but no ProbeRTT, and does not react to loss.
+type BBR struct {
+	state bbrState
+
+	bwSamples  [bbrBwWindow]float64 // per-round maximum delivery rates
+	round      int
+	roundStart time.Time
+
+	rtProp      time.Duration
+	rtPropStamp time.Time
+
+	fullBw       float64
+	fullBwRounds int
+	cycle        int
+
+	pacingGain float64
+	cwndGain   float64
+	inflight   int
+	segSize    float64 // average packet size, to turn bytes into packets
+}
+
+// NewBBR returns a BBR controller in Startup
+func NewBBR() *BBR {
+	return &BBR{pacingGain: bbrHighGain, cwndGain: bbrHighGain}
+}
+
+// btlBw is the bottleneck bandwidth estimate in bytes per second
+func (b *BBR) btlBw() float64 {
+	max := 0.0
+	for _, bw := range b.bwSamples {
+		if bw > max {
+			max = bw
+		}
+	}
+	return max
+}
+
+// bdp is the bandwidth-delay product in packets
+func (b *BBR) bdp() float64 {
+	return b.btlBw() * b.rtProp.Seconds() / b.segSize
+}
+
+func (b *BBR) OnAck(ev AckEvent) {
+	b.inflight = ev.Inflight
+	if b.segSize == 0 {
+		b.segSize = float64(ev.Bytes)
+	} else {
+		b.segSize = (7*b.segSize + float64(ev.Bytes)) / 8
+	}
+
+	if ev.RTT > 0 && (b.rtProp == 0 || ev.RTT <= b.rtProp || ev.Now.Sub(b.rtPropStamp) > bbrRTpropWindow) {
+		b.rtProp = ev.RTT
+		b.rtPropStamp = ev.Now
+	}
+
+	// Rounds are one minimum RTT long
+	if b.roundStart.IsZero() {
+		b.roundStart = ev.Now
+	} else if b.rtProp > 0 && ev.Now.Sub(b.roundStart) >= b.rtProp {
+		b.roundStart = ev.Now
+		b.round++
+		b.bwSamples[b.round%bbrBwWindow] = 0
+		b.onRound()
+	}
+	if slot := &b.bwSamples[b.round%bbrBwWindow]; ev.DeliveryRate > *slot {
+		*slot = ev.DeliveryRate
+	}
+
+	if b.state == bbrDrain && float64(b.inflight) <= b.bdp() {
+		b.state = bbrProbeBW
+		b.cycle = 0
+		b.pacingGain = bbrProbeGains[0]
+		b.cwndGain = bbrCwndGain
+	}
+}
+
+// onRound advances the state machine at the start of every round
+func (b *BBR) onRound() {
+	switch b.state {
+	case bbrStartup:
+		// The pipe is full once bandwidth stops growing by 25% per round
+		if bw := b.btlBw(); bw >= b.fullBw*bbrFullBwGrowth {
+			b.fullBw = bw
+			b.fullBwRounds = 0
+			return
+		}
+		b.fullBwRounds++
+		if b.fullBwRounds >= bbrFullBwRounds {
+			b.state = bbrDrain
+			b.pacingGain = 1 / bbrHighGain
+		}
+	case bbrProbeBW:
+		b.cycle = (b.cycle + 1) % len(bbrProbeGains)
+		b.pacingGain = bbrProbeGains[b.cycle]
+	}
+}
+
+func (b *BBR) OnLoss(ev LossEvent) {
+	b.inflight = ev.Inflight
+}
+
+func (b *BBR) Window() int {
+	if b.btlBw() == 0 || b.rtProp == 0 || b.segSize == 0 {
+		return InitialCwnd
+	}
+	w := int(math.Ceil(b.cwndGain * b.bdp()))
+	if w < bbrMinPipeWindow {
+		w = bbrMinPipeWindow
+	}
+	return w
+}
+
+func (b *BBR) PacingRate() float64 {
+	return b.pacingGain * b.btlBw()
+}
+
+// CwndSample is one point of a congestion window trace
+type CwndSample struct {
+	Time       time.Duration // since the sender started
+	Cwnd       int           // congestion window in packets
+	PacingRate float64       // bytes per second, 0 if unpaced
+	Inflight   int
+	Loss       bool // recorded for a loss event
+}
+
+// WriteCwndTrace writes trace as CSV with a header row, for plotting
+func WriteCwndTrace(w io.Writer, trace []CwndSample) error {
+	if _, err := fmt.Fprintln(w, "time_ms,cwnd,pacing_rate,inflight,loss"); err != nil {
+		return err
+	}
+	for _, s := range trace {
+		_, err := fmt.Fprintf(w, "%.3f,%d,%.0f,%d,%t\n",
+			float64(s.Time)/float64(time.Millisecond), s.Cwnd, s.PacingRate, s.Inflight, s.Loss)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,975 @@
+package reliable_udp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState is the lifecycle state of a Conn
+type ConnState int
+
+const (
+	// StateSynSent: Dial sent a SYN and waits for the SYN-ACK
+	StateSynSent ConnState = iota
+	// StateSynReceived: the listener answered a SYN and waits for the ACK
+	StateSynReceived
+	// StateEstablished: both sides may send data
+	StateEstablished
+	// StateFinWait: Close is flushing data and waiting for its FIN to be ACKed
+	StateFinWait
+	// StateCloseWait: the peer sent a FIN, local data may still be sent
+	StateCloseWait
+	// StateClosed: the connection is gone
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateSynSent:
+		return "SYN-SENT"
+	case StateSynReceived:
+		return "SYN-RECEIVED"
+	case StateEstablished:
+		return "ESTABLISHED"
+	case StateFinWait:
+		return "FIN-WAIT"
+	case StateCloseWait:
+		return "CLOSE-WAIT"
+	case StateClosed:
+		return "CLOSED"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+}
+
+var (
+	ErrConnClosed       = errors.New("connection closed")
+	ErrConnReset        = errors.New("connection reset by peer")
+	ErrHandshakeTimeout = errors.New("handshake timed out")
+	ErrIdleTimeout      = errors.New("connection idle timeout")
+
+	errReceiveCanceled = errors.New("receive canceled")
+)
+
+// Conn is a reliable, message-oriented connection to one peer. It is
+// created by Dial or Listener.Accept after a SYN / SYN-ACK / ACK handshake,
+// and owns its sequence space, retransmission state and settings.
+type Conn struct {
+	sock     *net.UDPConn
+	io       *batchConn // I/O on sock, shared with the listener
+	remote   *net.UDPAddr
+	listener *Listener // nil for dialed connections, which own sock
+	cfg      Config
+	crypto   atomic.Pointer[packetCrypto] // nil unless Config.Cipher is set
+
+	kx    *keyExchange // our side of the key exchange until it completes
+	hello []byte       // our half of the key exchange in the SYN or SYN-ACK
+
+	compressor Compressor // negotiated in the handshake; nil sends messages raw
+	probeMTU   bool       // Config.PathMTUDiscovery, and sock sets the DF bit
+
+	isn    int64 // our initial sequence number
+	seq    atomic.Int64
+	window *sendWindow
+	recv   *receiverState
+	stats  *Statistics
+
+	lastHeard atomic.Int64 // UnixNano of the last packet from the peer
+	lastSent  atomic.Int64 // UnixNano of the last packet to the peer
+
+	mu          sync.Mutex
+	state       ConnState
+	peerISN     int64
+	peerFin     bool
+	finSeq      int64
+	err         error
+	synAckTimer *time.Timer
+	synAckTries int
+	halfOpen    bool // counted in the listener's pending; guarded by its mu
+
+	established chan struct{} // closed once the handshake completes
+	finAcked    chan struct{} // closed once the peer ACKs our FIN
+	notify      chan struct{} // wakes Receive when messages are queued
+	done        chan struct{} // closed when the connection is closed
+	closeOnce   sync.Once
+}
+
+func newConn(sock *net.UDPConn, remote *net.UDPAddr, l *Listener, cfg Config, pc *packetCrypto, state ConnState) *Conn {
+	cfg = cfg.normalize()
+	st := newStatistics()
+	c := &Conn{
+		sock:        sock,
+		remote:      remote,
+		listener:    l,
+		cfg:         cfg,
+		isn:         rand.Int63n(1<<32) + 1,
+		stats:       st,
+		state:       state,
+		established: make(chan struct{}),
+		finAcked:    make(chan struct{}),
+		notify:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	c.crypto.Store(pc)
+	c.recv = newReceiverState(cfg, st, func(_ *net.UDPAddr, b []byte) error { return c.write(b) })
+	c.seq.Store(c.isn)
+	c.window = newSendWindow(cfg, st, c.write, func() int64 { return c.seq.Add(1) }, false)
+	c.lastHeard.Store(time.Now().UnixNano())
+	return c
+}
+
+// Dial connects to a listener at address and completes the handshake
+func Dial(address string, cfg Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+	pc, err := newHandshakeCrypto(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var kx *keyExchange
+	if cfg.KeyExchange {
+		if kx, err = newKeyExchange(cfg.normalize()); err != nil {
+			return nil, err
+		}
+	}
+	sock, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+
+	c := newConn(sock, raddr, nil, cfg, pc, StateSynSent)
+	c.io = newBatchConn(sock, c.cfg.BatchSize)
+	c.io.refused = func(p []byte, _ *net.UDPAddr, err error) { c.refused(len(p), err) }
+	c.probeMTU = cfg.PathMTUDiscovery && setDontFragment(sock) == nil
+	if kx != nil {
+		c.kx = kx
+		c.hello = kx.hello("syn", concat(isnBytes(c.isn), framed(c.synOffer())))
+	}
+	go c.readLoop()
+
+	if err := c.handshake(); err != nil {
+		c.close(err)
+		return nil, err
+	}
+	go c.keepalive()
+	return c, nil
+}
+
+// handshake sends SYNs according to the retry policy until the SYN-ACK
+// arrives or HandshakeTimeout passes
+func (c *Conn) handshake() error {
+	policy := c.cfg.RetryPolicy
+	timeout := time.NewTimer(c.cfg.HandshakeTimeout)
+	defer timeout.Stop()
+
+	syn := concat(c.hello, c.synOffer())
+
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		if err := c.sendControl(PacketSyn, c.isn, syn); err != nil {
+			return fmt.Errorf("send error: %v", err)
+		}
+
+		retry := time.NewTimer(policy.Delay(attempt, c.window.rtt.RTO()))
+		select {
+		case <-c.established:
+			retry.Stop()
+			if attempt == 0 {
+				c.window.rtt.sample(time.Since(start), 0)
+			}
+			return nil
+		case <-c.done:
+			retry.Stop()
+			return c.closeErr()
+		case <-timeout.C:
+			retry.Stop()
+			return ErrHandshakeTimeout
+		case <-retry.C:
+		}
+	}
+}
+
+// State returns the connection's lifecycle state
+func (c *Conn) State() ConnState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// LocalAddr returns the local network address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sock.LocalAddr()
+}
+
+// RemoteAddr returns the peer's network address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// RTO returns the connection's current retransmission timeout
+func (c *Conn) RTO() time.Duration {
+	return c.window.rtt.RTO()
+}
+
+// SRTT returns the connection's smoothed round-trip time
+func (c *Conn) SRTT() time.Duration {
+	return c.window.rtt.SRTT()
+}
+
+// CwndTrace returns the congestion window changes recorded so far. It is
+// empty unless Config.TraceCwnd is set and a congestion controller is used.
+func (c *Conn) CwndTrace() []CwndSample {
+	return c.window.cwndTrace()
+}
+
+// Statistics returns the counters of this connection
+func (c *Conn) Statistics() StatisticsCopy {
+	return c.stats.snapshot()
+}
+
+// Send queues a message, blocking while the send window is full. It returns
+// once the last packet is on the wire; use Flush to wait for the ACKs.
+func (c *Conn) Send(data []byte) error {
+	return c.SendWithPolicy(data, c.cfg.RetryPolicy)
+}
+
+// SendWithPolicy is like Send but retransmits this message according to
+// policy instead of the connection's retry policy
+func (c *Conn) SendWithPolicy(data []byte, policy RetryPolicy) error {
+	return c.send(data, policy, nil)
+}
+
+// send queues a message; it gives up with errSendCanceled if cancel is
+// closed before the message's first packet could be sent
+func (c *Conn) send(data []byte, policy RetryPolicy, cancel <-chan struct{}) error {
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+
+	if state != StateEstablished && state != StateCloseWait {
+		if err := c.closeErr(); err != nil {
+			return err
+		}
+		return ErrConnClosed
+	}
+	if !validateMessage(data) {
+		return fmt.Errorf("message size exceeds maximum allowed size of %d bytes", MaxMessageSize)
+	}
+	data, flags := c.compress(data)
+	return c.window.send(data, flags, policy, cancel)
+}
+
+// SendContext is like Send but gives up with ctx.Err() if ctx is done
+// before the message could enter the send window
+func (c *Conn) SendContext(ctx context.Context, data []byte) error {
+	err := c.send(data, c.cfg.RetryPolicy, ctx.Done())
+	if errors.Is(err, errSendCanceled) {
+		return fmt.Errorf("send abandoned: %w", ctx.Err())
+	}
+	return err
+}
+
+// Flush blocks until every sent message is acknowledged
+func (c *Conn) Flush() error {
+	return c.window.flush()
+}
+
+// Receive blocks until the next message from the peer is available. It
+// returns io.EOF once the peer has closed and all its messages were read.
+func (c *Conn) Receive() ([]byte, error) {
+	return c.receive(nil)
+}
+
+// ReceiveContext is like Receive but gives up with ctx.Err() once ctx is done
+func (c *Conn) ReceiveContext(ctx context.Context) ([]byte, error) {
+	data, err := c.receive(ctx.Done())
+	if errors.Is(err, errReceiveCanceled) {
+		return nil, fmt.Errorf("receive abandoned: %w", ctx.Err())
+	}
+	return data, err
+}
+
+// receive waits for the next message until cancel is closed, in which case
+// it returns errReceiveCanceled
+func (c *Conn) receive(cancel <-chan struct{}) ([]byte, error) {
+	for {
+		if d, ok := c.recv.pop(); ok {
+			return c.decompress(d)
+		}
+
+		c.mu.Lock()
+		peerFin, err := c.peerFin, c.err
+		c.mu.Unlock()
+		if peerFin {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-c.notify:
+		case <-c.done:
+		case <-cancel:
+			return nil, errReceiveCanceled
+		}
+	}
+}
+
+// Close flushes unacknowledged data for up to Config.Linger, then sends a
+// FIN and waits for it to be acknowledged. If the data cannot be flushed in
+// time the connection is reset instead and the flush error is returned.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	switch c.state {
+	case StateClosed:
+		c.mu.Unlock()
+		return nil
+	case StateFinWait:
+		c.mu.Unlock()
+		<-c.done
+		return nil
+	}
+	peerFin := c.peerFin
+	c.state = StateFinWait
+	c.mu.Unlock()
+
+	start := time.Now()
+	if err := c.window.flushTimeout(c.cfg.Linger); err != nil {
+		c.sendControl(PacketReset, 0, nil)
+		c.close(err)
+		return err
+	}
+
+	finSeq := c.seq.Add(1)
+	c.mu.Lock()
+	c.finSeq = finSeq
+	c.mu.Unlock()
+
+	policy := c.cfg.RetryPolicy
+	for attempt := 0; ; attempt++ {
+		c.sendControl(PacketFin, finSeq, nil)
+		if peerFin {
+			// The peer is already gone or about to be; don't wait for it
+			break
+		}
+
+		wait := policy.Delay(attempt, c.window.rtt.RTO())
+		if remaining := c.cfg.Linger - time.Since(start); wait > remaining {
+			wait = remaining
+		}
+		retry := time.NewTimer(wait)
+		select {
+		case <-c.finAcked:
+		case <-c.done:
+		case <-retry.C:
+			if !policy.Exhausted(attempt+1, time.Since(start)) && time.Since(start) < c.cfg.Linger {
+				continue
+			}
+		}
+		retry.Stop()
+		break
+	}
+
+	c.close(nil)
+	return nil
+}
+
+// close tears the connection down once; err is reported to blocked and
+// future callers (ErrConnClosed if nil)
+func (c *Conn) close(err error) {
+	c.closeOnce.Do(func() {
+		if err == nil {
+			err = ErrConnClosed
+		}
+
+		c.mu.Lock()
+		c.state = StateClosed
+		c.err = err
+		if c.synAckTimer != nil {
+			c.synAckTimer.Stop()
+		}
+		c.mu.Unlock()
+
+		c.window.stop(err)
+		close(c.done)
+
+		if c.listener != nil {
+			c.listener.remove(c)
+		} else {
+			// Send what is queued, such as a RST, before closing
+			c.io.close()
+			c.sock.Close()
+		}
+	})
+}
+
+// closeErr returns the error the connection was closed with, if any
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// write seals a datagram and sends it to the peer
+func (c *Conn) write(b []byte) error {
+	if b = c.crypto.Load().seal(b, c.cfg.Checksum); b == nil {
+		return errNoSessionKey
+	}
+	err := c.io.write(b, c.remote)
+	if err == nil {
+		c.lastSent.Store(time.Now().UnixNano())
+	}
+	return err
+}
+
+// sendControl sends a packet that is not part of the data stream
+func (c *Conn) sendControl(typ PacketType, seq int64, payload []byte) error {
+	return c.write(EncodePacket(Header{
+		Type:           typ,
+		SequenceNumber: seq,
+		Timestamp:      time.Now(),
+	}, payload))
+}
+
+// sendSynAck answers the peer's SYN; the payload echoes the peer's ISN,
+// followed by our half of the key exchange and the chosen compressor
+func (c *Conn) sendSynAck() error {
+	payload := concat(isnBytes(c.peerISN), c.hello, c.synAckOffer())
+	return c.sendControl(PacketSynAck, c.isn, payload)
+}
+
+// synOffer is the compressor offer of the dialer's SYN
+func (c *Conn) synOffer() []byte {
+	return appendOffer(nil, c.cfg.Compressors)
+}
+
+// synAckOffer is the compressor the listener chose, as offered in its
+// SYN-ACK
+func (c *Conn) synAckOffer() []byte {
+	if c.compressor == nil {
+		return nil
+	}
+	return appendOffer(nil, []Compressor{c.compressor})
+}
+
+// acceptKeyExchange checks the dialer's half of the key exchange in its
+// SYN, prepares our answer and switches to the session keys. Both halves
+// sign the compressor offers and the session keys are bound to them, so
+// that they cannot be changed on the way; offer is the one the SYN carried.
+func (c *Conn) acceptKeyExchange(msg, offer []byte) error {
+	kx, err := newKeyExchange(c.cfg)
+	if err != nil {
+		return err
+	}
+	peer, ok := kx.parseHello("syn", concat(isnBytes(c.peerISN), framed(offer)), msg)
+	if !ok {
+		return ErrAuthFailed
+	}
+	context := concat(isnBytes(c.peerISN, c.isn), peer.Bytes(), framed(offer), framed(c.synAckOffer()))
+	c.hello = kx.hello("syn-ack", context)
+
+	pc, err := kx.session(peer, concat(context, c.hello[:kexPublicSize]), false, c.crypto.Load().handshake, c.stats)
+	if err != nil {
+		return err
+	}
+	c.crypto.Store(pc)
+	return nil
+}
+
+// finishKeyExchange checks the listener's half of the key exchange in its
+// SYN-ACK, which carried offer, and switches to the session keys. Caller
+// must hold c.mu.
+func (c *Conn) finishKeyExchange(peerISN int64, msg, offer []byte) bool {
+	context := concat(isnBytes(c.isn, peerISN), c.hello[:kexPublicSize], framed(c.synOffer()), framed(offer))
+	peer, ok := c.kx.parseHello("syn-ack", context, msg)
+	if !ok {
+		return false
+	}
+
+	pc, err := c.kx.session(peer, concat(context, peer.Bytes()), true, c.crypto.Load().handshake, c.stats)
+	if err != nil {
+		return false
+	}
+	c.kx = nil
+	c.crypto.Store(pc)
+	return true
+}
+
+// retransmitSynAck resends the SYN-ACK until the handshake completes
+func (c *Conn) retransmitSynAck() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != StateSynReceived {
+		return
+	}
+	c.synAckTries++
+	c.sendSynAck()
+	c.synAckTimer.Reset(c.cfg.RetryPolicy.Delay(c.synAckTries, c.window.rtt.RTO()))
+}
+
+// establish completes the handshake. Caller must hold c.mu.
+func (c *Conn) establish() {
+	if c.state != StateSynSent && c.state != StateSynReceived {
+		return
+	}
+	c.state = StateEstablished
+	if c.synAckTimer != nil {
+		c.synAckTimer.Stop()
+	}
+	close(c.established)
+	if c.probeMTU {
+		c.window.startPMTU(c.remote, c.crypto.Load() != nil)
+	}
+}
+
+// signal wakes a blocked Receive
+func (c *Conn) signal() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// handlePacket dispatches one datagram from the peer
+func (c *Conn) handlePacket(h Header, payload []byte) {
+	c.lastHeard.Store(time.Now().UnixNano())
+
+	switch h.Type {
+	case PacketSyn:
+		c.mu.Lock()
+		if h.SequenceNumber == c.peerISN {
+			// Our SYN-ACK was lost
+			c.sendSynAck()
+		}
+		c.mu.Unlock()
+
+	case PacketSynAck:
+		size := 8 + helloSize(c.cfg)
+		if len(payload) < size || int64(binary.BigEndian.Uint64(payload)) != c.isn {
+			return
+		}
+		c.mu.Lock()
+		if c.state == StateSynSent {
+			if c.kx != nil && !c.finishKeyExchange(h.SequenceNumber, payload[8:size], payload[size:]) {
+				c.mu.Unlock()
+				return
+			}
+			c.compressor = chooseCompressor(c.cfg.Compressors, parseOffer(payload[size:]))
+			c.peerISN = h.SequenceNumber
+			c.recv.expect(c.remote, c.peerISN+1)
+			c.establish()
+		}
+		peerISN := c.peerISN
+		c.mu.Unlock()
+		// ACK every SYN-ACK, since a duplicate means our ACK was lost
+		c.sendControl(PacketAck, peerISN, nil)
+
+	case PacketAck:
+		c.mu.Lock()
+		switch {
+		case c.state == StateSynReceived && h.SequenceNumber == c.isn:
+			c.establish()
+			c.mu.Unlock()
+			c.listener.enqueue(c)
+		case c.finSeq != 0 && h.SequenceNumber == c.finSeq:
+			select {
+			case <-c.finAcked:
+			default:
+				close(c.finAcked)
+			}
+			c.mu.Unlock()
+		default:
+			c.mu.Unlock()
+			c.window.handleAck(h.SequenceNumber, decodeAck(h, payload))
+		}
+
+	case PacketData:
+		c.mu.Lock()
+		if c.state == StateSynSent {
+			c.mu.Unlock()
+			return
+		}
+		implicit := c.state == StateSynReceived
+		if implicit {
+			// The handshake ACK was lost but data proves the peer is set up
+			c.establish()
+		}
+		c.mu.Unlock()
+		if implicit {
+			c.listener.enqueue(c)
+		}
+		c.onData(h, payload)
+
+	case PacketFin:
+		c.sendControl(PacketAck, h.SequenceNumber, nil)
+		c.mu.Lock()
+		c.peerFin = true
+		if c.state == StateEstablished {
+			c.state = StateCloseWait
+		}
+		c.mu.Unlock()
+		c.signal()
+
+	case PacketNack:
+		c.window.handleNack(decodeNack(h, payload))
+
+	case PacketProbe:
+		c.write(encodeProbeAck(h))
+
+	case PacketProbeAck:
+		c.window.handleProbeAck(h.SequenceNumber)
+
+	case PacketParity:
+		if c.State() == StateSynSent || artificialDrop(c.stats) {
+			return
+		}
+		c.recv.addParity(c.remote, h, payload)
+		if c.recv.recoverLost(c.remote) > 0 {
+			c.signal()
+		}
+
+	case PacketReset:
+		c.close(ErrConnReset)
+	}
+}
+
+// onData runs a data packet through the receive path and ACKs it
+func (c *Conn) onData(h Header, payload []byte) {
+	if artificialDrop(c.stats) {
+		return
+	}
+
+	result, ack := c.recv.accept(c.remote, h, payload)
+	if ack == 0 {
+		return
+	}
+	c.recv.acknowledge(c.remote, h, ack, result)
+	if h.Flags&FlagFEC != 0 {
+		c.recv.recoverLost(c.remote)
+	}
+
+	if result == acceptDuplicate {
+		c.stats.onDuplicate()
+	}
+	c.signal()
+}
+
+// readLoop reads from a dialed connection's own socket
+func (c *Conn) readLoop() {
+	for {
+		ms, err := c.io.read()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// ICMP errors such as connection refused are reported on a
+			// connected socket; the peer may not be listening yet
+			continue
+		}
+
+		for _, m := range ms {
+			header, payload, err := decodeReceived(m.Buffers[0][:m.N], c.cfg.Checksum, c.stats, c.crypto.Load())
+			if err != nil {
+				continue
+			}
+			c.handlePacket(header, payload)
+		}
+	}
+}
+
+// keepalive pings an idle peer and closes the connection once nothing has
+// been heard from it for IdleTimeout
+func (c *Conn) keepalive() {
+	if c.cfg.IdleTimeout < 0 {
+		return
+	}
+	interval := c.cfg.IdleTimeout / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, c.lastHeard.Load())) > c.cfg.IdleTimeout {
+				c.close(ErrIdleTimeout)
+				return
+			}
+			if now.Sub(time.Unix(0, c.lastSent.Load())) >= interval {
+				c.sendControl(PacketPing, 0, nil)
+			}
+		}
+	}
+}
+
+// Listener accepts reliable_udp connections on one UDP socket and
+// demultiplexes packets to them by remote address
+type Listener struct {
+	sock     *net.UDPConn
+	io       *batchConn
+	cfg      Config
+	crypto   *packetCrypto // until an accepted connection has its own
+	probeMTU bool          // Config.PathMTUDiscovery, and sock sets the DF bit
+
+	mu      sync.Mutex
+	conns   map[string]*Conn
+	pending int // conns still in StateSynReceived
+	backlog chan *Conn
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenBacklog is how many established connections may wait for Accept
+const ListenBacklog = 128
+
+// Listen starts accepting connections on address
+func Listen(address string, cfg Config) (*Listener, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+	pc, err := newHandshakeCrypto(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	l := &Listener{
+		sock:     sock,
+		cfg:      cfg.normalize(),
+		crypto:   pc,
+		probeMTU: cfg.PathMTUDiscovery && setDontFragment(sock) == nil,
+		conns:    make(map[string]*Conn),
+		backlog:  make(chan *Conn, ListenBacklog),
+		done:     make(chan struct{}),
+	}
+	l.io = newBatchConn(sock, l.cfg.BatchSize)
+	l.io.refused = l.refused
+	go l.readLoop()
+	return l, nil
+}
+
+// Accept waits for the next connection that completed the handshake
+func (l *Listener) Accept() (*Conn, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.done:
+		return nil, ErrConnClosed
+	}
+}
+
+// Addr returns the listener's network address
+func (l *Listener) Addr() net.Addr {
+	return l.sock.LocalAddr()
+}
+
+// Close stops accepting connections and closes the socket. Connections
+// accepted from this listener share the socket and are closed as well.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.io.close()
+		err = l.sock.Close()
+
+		l.mu.Lock()
+		conns := make([]*Conn, 0, len(l.conns))
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.mu.Unlock()
+
+		for _, c := range conns {
+			c.close(ErrConnClosed)
+		}
+	})
+	return err
+}
+
+// enqueue hands an established connection to Accept, resetting it if the
+// backlog is full
+func (l *Listener) enqueue(c *Conn) {
+	l.mu.Lock()
+	l.settleLocked(c)
+	l.mu.Unlock()
+
+	select {
+	case l.backlog <- c:
+	default:
+		c.sendControl(PacketReset, 0, nil)
+		c.close(ErrConnReset)
+	}
+}
+
+// remove forgets a closed connection
+func (l *Listener) remove(c *Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.settleLocked(c)
+	key := c.remote.String()
+	if l.conns[key] == c {
+		delete(l.conns, key)
+	}
+}
+
+// refused passes a datagram the kernel refused to send to addr on to that
+// connection
+func (l *Listener) refused(p []byte, addr *net.UDPAddr, err error) {
+	l.mu.Lock()
+	c, ok := l.conns[addr.String()]
+	l.mu.Unlock()
+	if ok {
+		c.refused(len(p), err)
+	}
+}
+
+// settleLocked stops counting c as half-open once it is established or
+// closed. Caller must hold l.mu.
+func (l *Listener) settleLocked(c *Conn) {
+	if c.halfOpen {
+		c.halfOpen = false
+		l.pending--
+	}
+}
+
+// readLoop demultiplexes incoming datagrams to their connections and
+// answers new SYNs
+func (l *Listener) readLoop() {
+	for {
+		ms, err := l.io.read()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+		}
+		for _, m := range ms {
+			l.handleDatagram(m.Buffers[0][:m.N], m.Addr.(*net.UDPAddr))
+		}
+	}
+}
+
+// handleDatagram passes a datagram from addr to its connection, opens a
+// connection for a SYN and resets unknown peers
+func (l *Listener) handleDatagram(buf []byte, addr *net.UDPAddr) {
+	key := addr.String()
+	l.mu.Lock()
+	c, ok := l.conns[key]
+	l.mu.Unlock()
+
+	st, pc := &stats, l.crypto
+	if ok {
+		st, pc = c.stats, c.crypto.Load()
+	}
+	header, payload, err := decodeReceived(buf, l.cfg.Checksum, st, pc)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	c, ok = l.conns[key]
+	if !ok && header.Type == PacketSyn {
+		if l.pending >= l.cfg.MaxPending {
+			// Too many handshakes in progress; the peer retries its SYN
+			l.mu.Unlock()
+			return
+		}
+		if c = l.open(addr, header.SequenceNumber, payload); c != nil {
+			c.halfOpen = true
+			l.pending++
+			l.conns[key] = c
+		}
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+
+	if ok {
+		c.handlePacket(header, payload)
+	} else if header.Type != PacketReset {
+		// Nothing is known about this peer; tell it to give up
+		rst := l.crypto.seal(EncodePacket(Header{
+			Type:           PacketReset,
+			SequenceNumber: header.SequenceNumber,
+			Timestamp:      time.Now(),
+		}, nil), l.cfg.Checksum)
+		if rst != nil {
+			l.io.write(rst, addr)
+		}
+	}
+}
+
+// open creates a half-open connection for a SYN from addr and answers it,
+// choosing a compressor among those the SYN payload offers. It returns nil
+// if the SYN's half of the key exchange is not acceptable. Caller must hold
+// l.mu.
+func (l *Listener) open(addr *net.UDPAddr, peerISN int64, syn []byte) *Conn {
+	remote := copyAddr(addr)
+	c := newConn(l.sock, remote, l, l.cfg, l.crypto, StateSynReceived)
+	c.io = l.io
+	c.peerISN = peerISN
+	c.probeMTU = l.probeMTU
+	size := helloSize(c.cfg)
+	if len(syn) < size {
+		return nil
+	}
+	c.compressor = chooseCompressor(c.cfg.Compressors, parseOffer(syn[size:]))
+	if l.cfg.KeyExchange {
+		if err := c.acceptKeyExchange(syn[:size], syn[size:]); err != nil {
+			return nil
+		}
+	}
+	c.recv.expect(remote, peerISN+1)
+
+	c.mu.Lock()
+	c.sendSynAck()
+	c.synAckTimer = time.AfterFunc(c.cfg.RetryPolicy.Delay(0, c.window.rtt.RTO()), c.retransmitSynAck)
+	c.mu.Unlock()
+
+	// Reap the connection if the handshake never completes
+	time.AfterFunc(c.cfg.HandshakeTimeout, func() {
+		if c.State() == StateSynReceived {
+			c.close(ErrHandshakeTimeout)
+		}
+	})
+	go c.keepalive()
+	return c
+}
+
+// refused tells path MTU discovery about a datagram of size bytes that a
+// batched write failed to send because it was too large
+func (c *Conn) refused(size int, err error) {
+	if isMessageTooLong(err) {
+		c.window.pmtuRefused(size)
+	}
+}
+
+// copyAddr returns a copy of addr that does not share its IP with a read
+// buffer
+func copyAddr(addr *net.UDPAddr) *net.UDPAddr {
+	return &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port, Zone: addr.Zone}
+}
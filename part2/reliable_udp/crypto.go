@@ -0,0 +1,465 @@
+package reliable_udp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeySize is the length of a pre-shared key
+const KeySize = 32
+
+const (
+	saltSize     = 16
+	nonceSize    = 12
+	packetIDSize = saltSize + 8 // sender salt and packet number
+	tagSize      = 16
+	sealOverhead = packetIDSize + tagSize
+
+	// replayWindowSize is how many packet numbers below the highest one
+	// seen from a sender are still accepted
+	replayWindowSize = 1024
+	// maxSenders is how many senders a receiver keeps subkeys and replay
+	// windows for; the one heard from least recently is forgotten first
+	maxSenders = 1024
+)
+
+var (
+	ErrAuthFailed = errors.New("packet authentication failed")
+	ErrReplay     = errors.New("replayed packet")
+)
+
+// Cipher selects the authenticated encryption applied to every packet
+type Cipher int
+
+const (
+	// CipherNone sends packets in the clear
+	CipherNone Cipher = iota
+	// CipherAESGCM is AES-256-GCM, the fastest choice on CPUs with AES
+	// instructions
+	CipherAESGCM
+	// CipherChaCha20Poly1305 is ChaCha20-Poly1305, the faster choice
+	// without AES hardware support
+	CipherChaCha20Poly1305
+)
+
+func (c Cipher) String() string {
+	switch c {
+	case CipherNone:
+		return "none"
+	case CipherAESGCM:
+		return "aes-gcm"
+	case CipherChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return fmt.Sprintf("Cipher(%d)", int(c))
+	}
+}
+
+// packetCrypto seals outgoing and opens incoming datagrams.
+//
+// A sealed datagram keeps its header in the clear, with FlagEncrypted set
+// and the length covering the rest. The payload is replaced by the nonce,
+// the ciphertext and the tag. The header, with its checksum field zeroed,
+// is authenticated as additional data; the checksum is computed last, over
+// the sealed datagram.
+//
+// Every sender picks a random 16-byte salt and seals with a subkey derived
+// from the key and its salt, so that senders sharing a pre-shared key do not
+// share a subkey. The salt and a packet number precede the ciphertext. The
+// packet number grows with every datagram sealed, retransmissions included,
+// and is the nonce, so a nonce never repeats under one subkey and a
+// retransmission is not a replay.
+//
+// A static packetCrypto uses the pre-shared key in both directions. A
+// session packetCrypto, set up by a key exchange, has a key per direction
+// and leaves SYN and SYN-ACK to its handshake protection. Its sending key
+// is replaced by the next generation derived from it after rekeyPackets
+// packets or rekeyBytes bytes, and FlagKeyPhase tells the peer which
+// generation to open a packet with.
+type packetCrypto struct {
+	salt [saltSize]byte
+
+	session      bool
+	handshake    *packetCrypto // protects SYN and SYN-ACK of a session; nil sends them in the clear
+	rekeyPackets int64
+	rekeyBytes   int64
+	stats        *Statistics // counts the key updates of a session
+
+	mu        sync.Mutex
+	pn        uint64
+	send      *trafficKey // nil until a session has keys
+	sealer    cipher.AEAD // send's subkey for salt
+	sealerKey *trafficKey // the key sealer was derived from
+	recv      *trafficKey
+	prevRecv  *trafficKey                     // for packets the peer sealed before its last key update
+	senders   map[[saltSize]byte]*senderState // by sender salt, at most maxSenders
+	clock     uint64                          // counts authenticated packets, to find the least recent sender
+}
+
+// senderState is what a receiver keeps about one sender salt
+type senderState struct {
+	subkeys  map[*trafficKey]cipher.AEAD
+	replay   replayWindow
+	lastUsed uint64 // packetCrypto.clock at its last authenticated packet
+}
+
+// trafficKey is one generation of a key
+type trafficKey struct {
+	cipher Cipher
+	secret []byte
+	phase  bool // generation parity, sent as FlagKeyPhase
+
+	packets int64  // packets sealed with this key
+	bytes   int64  // payload bytes sealed with this key
+	firstPN uint64 // first packet number opened with this key
+	next    *trafficKey
+}
+
+func newTrafficKey(c Cipher, secret []byte, phase bool) (*trafficKey, error) {
+	if _, err := newAEAD(c, secret); err != nil {
+		return nil, err
+	}
+	return &trafficKey{cipher: c, secret: secret, phase: phase}, nil
+}
+
+func newAEAD(c Cipher, secret []byte) (cipher.AEAD, error) {
+	var aead cipher.AEAD
+	var err error
+	switch c {
+	case CipherAESGCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(secret); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	case CipherChaCha20Poly1305:
+		aead, err = chacha20poly1305.New(secret)
+	default:
+		return nil, fmt.Errorf("unknown cipher %v", c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return aead, nil
+}
+
+// subkey derives the key the sender with salt seals with under k
+func (k *trafficKey) subkey(salt [saltSize]byte) (cipher.AEAD, error) {
+	secret := make([]byte, KeySize)
+	r := hkdf.New(sha256.New, k.secret, salt[:], []byte("reliable_udp sender key"))
+	if _, err := io.ReadFull(r, secret); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	return newAEAD(k.cipher, secret)
+}
+
+// nextKey derives the following generation. The current secret cannot be
+// recovered from it, so dropping the current key makes what it protected
+// unreadable.
+func (k *trafficKey) nextKey() (*trafficKey, error) {
+	if k.next != nil {
+		return k.next, nil
+	}
+	secret := make([]byte, KeySize)
+	r := hkdf.Expand(sha256.New, k.secret, []byte("reliable_udp key update"))
+	if _, err := io.ReadFull(r, secret); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	next, err := newTrafficKey(k.cipher, secret, !k.phase)
+	if err != nil {
+		return nil, err
+	}
+	k.next = next
+	return next, nil
+}
+
+// newPacketCrypto returns the static packet protection cfg asks for, or nil
+// if packets are sent in the clear
+func newPacketCrypto(cfg Config) (*packetCrypto, error) {
+	if cfg.KeyExchange {
+		return nil, errKeyExchangeUnsupported
+	}
+	if cfg.Cipher == CipherNone {
+		return nil, nil
+	}
+	if len(cfg.Key) != KeySize {
+		return nil, fmt.Errorf("invalid key: %d bytes, want %d", len(cfg.Key), KeySize)
+	}
+
+	k, err := newTrafficKey(cfg.Cipher, cfg.Key, false)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := newCrypto()
+	if err != nil {
+		return nil, err
+	}
+	pc.send, pc.recv = k, k
+	return pc, nil
+}
+
+// newCrypto returns a packetCrypto with a fresh salt and no keys
+func newCrypto() (*packetCrypto, error) {
+	pc := &packetCrypto{senders: make(map[[saltSize]byte]*senderState)}
+	if _, err := crand.Read(pc.salt[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return pc, nil
+}
+
+// isHandshake reports whether packets of type t are protected by a
+// session's handshake protection
+func isHandshake(t PacketType) bool {
+	return t == PacketSyn || t == PacketSynAck
+}
+
+// seal encrypts an encoded datagram and checksums the result with alg. A
+// nil packetCrypto only changes the checksum. It returns nil if a session
+// has no keys for the datagram yet.
+func (pc *packetCrypto) seal(wire []byte, alg Checksum) []byte {
+	if pc == nil {
+		return alg.stamp(wire)
+	}
+	if pc.session && isHandshake(PacketType(wire[3])) {
+		return pc.handshake.seal(wire, alg)
+	}
+
+	pc.mu.Lock()
+	k := pc.sendKey()
+	if k == nil {
+		pc.mu.Unlock()
+		return nil
+	}
+	if pc.sealerKey != k {
+		aead, err := k.subkey(pc.salt)
+		if err != nil {
+			pc.mu.Unlock()
+			return nil
+		}
+		pc.sealer, pc.sealerKey = aead, k
+	}
+	aead := pc.sealer
+	k.packets++
+	k.bytes += int64(len(wire) - HeaderSize)
+	pc.pn++
+	pn := pc.pn
+	pc.mu.Unlock()
+
+	out := make([]byte, HeaderSize+packetIDSize, len(wire)+sealOverhead)
+	copy(out, wire[:HeaderSize])
+	flags := binary.BigEndian.Uint16(out[4:6]) | FlagEncrypted
+	if k.phase {
+		flags |= FlagKeyPhase
+	}
+	binary.BigEndian.PutUint16(out[4:6], flags)
+	binary.BigEndian.PutUint16(out[6:8], uint16(len(wire)-HeaderSize+sealOverhead))
+	binary.BigEndian.PutUint32(out[checksumOffset:], 0)
+
+	id := out[HeaderSize:]
+	copy(id, pc.salt[:])
+	binary.BigEndian.PutUint64(id[saltSize:], pn)
+
+	nonce := packetNonce(pn)
+	out = aead.Seal(out, nonce[:], wire[HeaderSize:], out[:HeaderSize])
+	binary.BigEndian.PutUint32(out[checksumOffset:], alg.sum(out))
+	return out
+}
+
+// sendKey returns the key to seal the next packet with, moving on to the
+// next generation once the current one reached its limits. Caller must
+// hold pc.mu.
+func (pc *packetCrypto) sendKey() *trafficKey {
+	k := pc.send
+	if k == nil || !pc.session {
+		return k
+	}
+	if k.packets < pc.rekeyPackets && k.bytes < pc.rekeyBytes {
+		return k
+	}
+	next, err := k.nextKey()
+	if err != nil {
+		return k
+	}
+	pc.send = next
+	pc.stats.add(func(s *Statistics) { s.keyUpdates++ })
+	return next
+}
+
+// recvKey picks the key a packet was sealed with from its key phase: the
+// current one, the previous one for packets sealed before the peer's last
+// key update, or the next one, for which advance is set. Caller must hold
+// pc.mu.
+func (pc *packetCrypto) recvKey(phase bool, pn uint64) (k *trafficKey, advance bool) {
+	cur := pc.recv
+	switch {
+	case cur == nil:
+		return nil, false
+	case phase == cur.phase:
+		return cur, false
+	case !pc.session:
+		return nil, false
+	case pc.prevRecv != nil && pn < cur.firstPN:
+		return pc.prevRecv, false
+	}
+	next, err := cur.nextKey()
+	if err != nil {
+		return nil, false
+	}
+	return next, true
+}
+
+// open authenticates and decrypts the payload of a decoded datagram in
+// place, and rejects datagrams seen before. Without a key, only plaintext
+// datagrams are accepted.
+func (pc *packetCrypto) open(buf []byte, h Header, payload []byte) (Header, []byte, error) {
+	encrypted := h.Flags&FlagEncrypted != 0
+	if pc == nil {
+		if encrypted {
+			return Header{}, nil, ErrAuthFailed
+		}
+		return h, payload, nil
+	}
+	if pc.session && isHandshake(h.Type) {
+		return pc.handshake.open(buf, h, payload)
+	}
+	if !encrypted || len(payload) < sealOverhead {
+		return Header{}, nil, ErrAuthFailed
+	}
+
+	var aad [HeaderSize]byte
+	copy(aad[:], buf[:HeaderSize])
+	binary.BigEndian.PutUint32(aad[checksumOffset:], 0)
+
+	var salt [saltSize]byte
+	copy(salt[:], payload)
+	pn := binary.BigEndian.Uint64(payload[saltSize:packetIDSize])
+	if salt == pc.salt {
+		// One of our own datagrams reflected back at us
+		return Header{}, nil, ErrReplay
+	}
+
+	pc.mu.Lock()
+	k, advance := pc.recvKey(h.Flags&FlagKeyPhase != 0, pn)
+	var aead cipher.AEAD
+	if s := pc.senders[salt]; s != nil && k != nil {
+		aead = s.subkeys[k]
+	}
+	pc.mu.Unlock()
+	if k == nil {
+		return Header{}, nil, ErrAuthFailed
+	}
+	if aead == nil {
+		var err error
+		if aead, err = k.subkey(salt); err != nil {
+			return Header{}, nil, ErrAuthFailed
+		}
+	}
+	nonce := packetNonce(pn)
+	plain, err := aead.Open(payload[packetIDSize:packetIDSize], nonce[:], payload[packetIDSize:], aad[:])
+	if err != nil {
+		return Header{}, nil, ErrAuthFailed
+	}
+
+	// Only authenticated packets may update the keys and the senders
+	pc.mu.Lock()
+	if advance && pc.recv.next == k {
+		pc.prevRecv, pc.recv = pc.recv, k
+		k.firstPN = pn
+	}
+	s := pc.senderLocked(salt)
+	s.subkeys[k] = aead
+	fresh := s.replay.check(pn)
+	if fresh {
+		s.replay.record(pn)
+	}
+	pc.mu.Unlock()
+	if !fresh {
+		return Header{}, nil, ErrReplay
+	}
+
+	h.Flags &^= FlagEncrypted | FlagKeyPhase
+	h.PayloadLength = uint16(len(plain))
+	return h, plain, nil
+}
+
+// senderLocked returns the state kept for the sender with salt, making
+// room for it by forgetting the least recently heard sender if needed, and
+// drops its subkeys of generations no longer in use. Packets of a forgotten
+// sender pass the replay check again, which takes maxSenders other senders
+// heard from since. Caller must hold pc.mu.
+func (pc *packetCrypto) senderLocked(salt [saltSize]byte) *senderState {
+	pc.clock++
+	s := pc.senders[salt]
+	if s == nil {
+		if len(pc.senders) >= maxSenders {
+			var oldest [saltSize]byte
+			least := pc.clock
+			for salt, s := range pc.senders {
+				if s.lastUsed < least {
+					oldest, least = salt, s.lastUsed
+				}
+			}
+			delete(pc.senders, oldest)
+		}
+		s = &senderState{subkeys: make(map[*trafficKey]cipher.AEAD)}
+		pc.senders[salt] = s
+	}
+	s.lastUsed = pc.clock
+	for k := range s.subkeys {
+		if k != pc.recv && k != pc.prevRecv {
+			delete(s.subkeys, k)
+		}
+	}
+	return s
+}
+
+// packetNonce is the nonce of packet number pn
+func packetNonce(pn uint64) (nonce [nonceSize]byte) {
+	binary.BigEndian.PutUint64(nonce[nonceSize-8:], pn)
+	return nonce
+}
+
+// replayWindow tracks which of the last replayWindowSize packet numbers of
+// one sender were received. Packet numbers start at 1.
+type replayWindow struct {
+	highest uint64
+	seen    [replayWindowSize / 64]uint64
+}
+
+// check reports whether pn is new and not too old to tell
+func (w *replayWindow) check(pn uint64) bool {
+	if pn == 0 {
+		return false
+	}
+	if pn > w.highest {
+		return true
+	}
+	if w.highest-pn >= replayWindowSize {
+		return false
+	}
+	return w.seen[pn/64%uint64(len(w.seen))]&(1<<(pn%64)) == 0
+}
+
+// record marks pn as received, sliding the window forward if needed
+func (w *replayWindow) record(pn uint64) {
+	if pn > w.highest {
+		if pn-w.highest >= replayWindowSize {
+			w.seen = [replayWindowSize / 64]uint64{}
+		} else {
+			for n := w.highest + 1; n < pn; n++ {
+				w.seen[n/64%uint64(len(w.seen))] &^= 1 << (n % 64)
+			}
+		}
+		w.highest = pn
+	}
+	w.seen[pn/64%uint64(len(w.seen))] |= 1 << (pn % 64)
+}
@@ -0,0 +1,282 @@
+package reliable_udp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Forward error correction
+//
+// With Config.FECGroup set to K, the sender follows every K data packets
+// with a parity packet: the XOR of their payloads, padded to the longest,
+// together with the XOR of their flags and lengths. The header's sequence
+// number is the first of the group, which covers consecutive sequence
+// numbers. A group that is not full after a quarter of the RTO is closed
+// early, so that the last packets of a burst are protected too.
+//
+// The receiver keeps the packets of recent groups. Once all but one packet
+// of a group and its parity have arrived, the missing packet is rebuilt and
+// ACKed as if it had arrived, before its retransmit timer fires. Parity
+// packets are never retransmitted.
+
+const (
+	// MaxFECGroup is the largest number of data packets per parity packet
+	MaxFECGroup = 64
+
+	// fecHeaderSize is the group size and the XOR of flags and lengths that
+	// start a parity payload
+	fecHeaderSize = 5
+	// fecHistory is how far below the next expected sequence number
+	// received packets are kept for recovery
+	fecHistory = 4 * MaxFECGroup
+)
+
+// fecGroup is the parity of the data packets sent since the last parity
+// packet
+type fecGroup struct {
+	first  int64
+	count  int
+	flags  uint16
+	length uint16
+	parity []byte
+	timer  *time.Timer
+}
+
+// add XORs a packet into the group
+func (g *fecGroup) add(flags uint16, payload []byte) {
+	g.count++
+	g.flags ^= flags
+	g.length ^= uint16(len(payload))
+	if n := len(payload) - len(g.parity); n > 0 {
+		g.parity = append(g.parity, make([]byte, n)...)
+	}
+	for i, b := range payload {
+		g.parity[i] ^= b
+	}
+}
+
+// fecAdd adds the first transmission of a data packet to the open parity
+// group and sends the parity once the group is full. Caller must hold w.mu.
+func (w *sendWindow) fecAdd(seq int64, flags uint16, payload []byte) {
+	g := &w.fec
+	if g.count > 0 && seq != g.first+int64(g.count) {
+		// Another sender on the socket took the sequence numbers in between
+		w.fecFlush()
+	}
+	if g.count == 0 {
+		g.first = seq
+		g.timer = time.AfterFunc(w.rtt.RTO()/4, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.fec.count > 0 && w.fec.first == seq && w.err == nil && !w.closed {
+				w.fecFlush()
+			}
+		})
+	}
+	g.add(flags, payload)
+	if g.count >= w.cfg.FECGroup {
+		w.fecFlush()
+	}
+}
+
+// fecFlush sends the parity of the open group, if any. Caller must hold
+// w.mu.
+func (w *sendWindow) fecFlush() {
+	g := &w.fec
+	if g.count == 0 {
+		return
+	}
+	g.timer.Stop()
+
+	payload := make([]byte, fecHeaderSize+len(g.parity))
+	payload[0] = byte(g.count)
+	binary.BigEndian.PutUint16(payload[1:3], g.flags)
+	binary.BigEndian.PutUint16(payload[3:5], g.length)
+	copy(payload[fecHeaderSize:], g.parity)
+	wire := EncodePacket(Header{
+		Type:           PacketParity,
+		SequenceNumber: g.first,
+		Timestamp:      time.Now(),
+	}, payload)
+	if err := w.write(wire); err == nil {
+		w.stats.onParitySent(len(payload))
+	}
+	*g = fecGroup{}
+}
+
+// parityGroup is a received parity packet waiting for its group
+type parityGroup struct {
+	count  int
+	flags  uint16
+	length uint16
+	parity []byte
+}
+
+// recordFEC keeps a copy of a data packet that belongs to a parity group.
+// Caller must hold r.mu.
+func (p *peerState) recordFEC(h Header, payload []byte) {
+	if p.fecPackets == nil {
+		p.fecPackets = make(map[int64]segment)
+		p.parities = make(map[int64]*parityGroup)
+	}
+	if _, ok := p.fecPackets[h.SequenceNumber]; ok {
+		return
+	}
+	if len(p.fecPackets) >= fecHistory+ReorderBufferSize {
+		p.pruneFEC()
+		if len(p.fecPackets) >= fecHistory+ReorderBufferSize {
+			return
+		}
+	}
+	p.fecPackets[h.SequenceNumber] = segment{flags: h.Flags, data: append([]byte(nil), payload...)}
+}
+
+// pruneFEC forgets packets and parity groups too old to help recovery.
+// Caller must hold r.mu.
+func (p *peerState) pruneFEC() {
+	horizon := p.next - fecHistory
+	for seq := range p.fecPackets {
+		if seq < horizon {
+			delete(p.fecPackets, seq)
+		}
+	}
+	for first, g := range p.parities {
+		if first+int64(g.count) <= horizon {
+			delete(p.parities, first)
+		}
+	}
+}
+
+// addParity stores a parity packet from addr until its group can be
+// checked for a missing packet
+func (r *receiverState) addParity(addr *net.UDPAddr, h Header, payload []byte) {
+	if len(payload) < fecHeaderSize || payload[0] == 0 || int(payload[0]) > MaxFECGroup {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := addr.String()
+	peer, ok := r.peers[key]
+	if !ok {
+		peer = newPeerState()
+		r.peers[key] = peer
+	}
+	if peer.parities == nil {
+		peer.fecPackets = make(map[int64]segment)
+		peer.parities = make(map[int64]*parityGroup)
+	}
+	if len(peer.parities) >= fecHistory {
+		peer.pruneFEC()
+		if len(peer.parities) >= fecHistory {
+			return
+		}
+	}
+	peer.parities[h.SequenceNumber] = &parityGroup{
+		count:  int(payload[0]),
+		flags:  binary.BigEndian.Uint16(payload[1:3]),
+		length: binary.BigEndian.Uint16(payload[3:5]),
+		parity: append([]byte(nil), payload[fecHeaderSize:]...),
+	}
+}
+
+// discarded returns the next in-order packet from addr if it arrived but
+// was discarded, as Go-Back-N does with packets behind a gap that parity
+// has since filled
+func (r *receiverState) discarded(addr *net.UDPAddr) (Header, []byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peer, ok := r.peers[addr.String()]
+	if !ok || peer.next == 0 {
+		return Header{}, nil, false
+	}
+	seg, ok := peer.fecPackets[peer.next]
+	if !ok {
+		return Header{}, nil, false
+	}
+	return Header{
+		Type:           PacketData,
+		Flags:          seg.flags,
+		SequenceNumber: peer.next,
+		PayloadLength:  uint16(len(seg.data)),
+	}, seg.data, true
+}
+
+// reconstruct rebuilds a packet from addr that is the only one missing from
+// a group whose parity arrived. Groups that are complete, or whose missing
+// packet is no longer needed, are forgotten.
+func (r *receiverState) reconstruct(addr *net.UDPAddr) (Header, []byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peer, ok := r.peers[addr.String()]
+	if !ok {
+		return Header{}, nil, false
+	}
+	for first, g := range peer.parities {
+		missing, n := int64(0), 0
+		for seq := first; seq < first+int64(g.count); seq++ {
+			if _, ok := peer.fecPackets[seq]; !ok {
+				missing = seq
+				n++
+			}
+		}
+		if n > 1 {
+			continue
+		}
+		delete(peer.parities, first)
+		if n == 0 || peer.next != 0 && missing < peer.next {
+			continue
+		}
+
+		flags, length, data := g.flags, g.length, g.parity
+		for seq := first; seq < first+int64(g.count); seq++ {
+			seg, ok := peer.fecPackets[seq]
+			if !ok {
+				continue
+			}
+			flags ^= seg.flags
+			length ^= uint16(len(seg.data))
+			for i, b := range seg.data {
+				if i < len(data) {
+					data[i] ^= b
+				}
+			}
+		}
+		if int(length) > len(data) || flags&FlagFEC == 0 {
+			// Inconsistent with the packets that did arrive
+			continue
+		}
+		return Header{
+			Type:           PacketData,
+			Flags:          flags,
+			SequenceNumber: missing,
+			PayloadLength:  length,
+		}, data[:length], true
+	}
+	return Header{}, nil, false
+}
+
+// recoverLost runs every packet from addr that parity makes recoverable,
+// and every packet discarded behind one, through accept and ACKs it, so
+// that the sender does not retransmit it. It returns the number of packets
+// rebuilt from parity.
+func (r *receiverState) recoverLost(addr *net.UDPAddr) int {
+	n := 0
+	for {
+		h, payload, ok := r.discarded(addr)
+		if !ok {
+			if h, payload, ok = r.reconstruct(addr); !ok {
+				return n
+			}
+			n++
+			r.stats.onFECRecovered()
+		}
+		if result, ack := r.accept(addr, h, payload); ack != 0 {
+			r.acknowledge(addr, h, ack, result)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package reliable_udp
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// FragmentHeaderSize is the fragment index and count that prefix the
+	// payload of every packet carrying FlagFragment
+	FragmentHeaderSize = 4
+	// MaxFragmentData is the message data carried by one fragment of
+	// MaxPacketSize bytes
+	MaxFragmentData = MaxPacketSize - FragmentHeaderSize
+	// MaxMessageSize is the largest message that can be sent reliably
+	MaxMessageSize = 4 << 20
+	// ReassemblyTimeout discards a partially received message whose next
+	// fragment has not arrived in time
+	ReassemblyTimeout = 5 * time.Second
+	// ReassemblyBufferSize bounds the bytes held in partially received
+	// messages across all senders of one socket
+	ReassemblyBufferSize = 16 << 20
+)
+
+// reassembly is a fragmented message that is partially received
+type reassembly struct {
+	next     uint16 // index of the next expected fragment
+	count    uint16
+	data     []byte
+	lastSeen time.Time
+}
+
+// validateMessage checks if the message size is within limits
+func validateMessage(data []byte) bool {
+	return len(data) <= MaxMessageSize
+}
+
+// fragmentMessage splits data into payloads of at most size bytes. A
+// message that fits in one packet is returned as is with fragmented set to
+// false; otherwise every payload starts with its fragment index and the
+// fragment count.
+func fragmentMessage(data []byte, size int) (payloads [][]byte, fragmented bool) {
+	if len(data) <= size {
+		return [][]byte{data}, false
+	}
+
+	chunkSize := size - FragmentHeaderSize
+	count := (len(data) + chunkSize - 1) / chunkSize
+	payloads = make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := data[i*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+
+		payload := make([]byte, FragmentHeaderSize+len(chunk))
+		binary.BigEndian.PutUint16(payload[0:2], uint16(i))
+		binary.BigEndian.PutUint16(payload[2:4], uint16(count))
+		copy(payload[FragmentHeaderSize:], chunk)
+		payloads = append(payloads, payload)
+	}
+	return payloads, true
+}
+
+// reassemble feeds an in-order segment from peer into its reassembly state
+// and returns a complete message when one is available. Fragments that do
+// not continue the partial message (because an earlier one was abandoned or
+// it timed out) discard it. Caller must hold r.mu.
+func (r *receiverState) reassemble(peer *peerState, seg segment) ([]byte, bool) {
+	now := time.Now()
+	if peer.partial != nil && now.Sub(peer.partial.lastSeen) > ReassemblyTimeout {
+		r.dropPartial(peer)
+	}
+
+	if seg.flags&FlagFragment == 0 {
+		r.dropPartial(peer)
+		return seg.data, true
+	}
+	if len(seg.data) < FragmentHeaderSize {
+		r.dropPartial(peer)
+		return nil, false
+	}
+
+	index := binary.BigEndian.Uint16(seg.data[0:2])
+	count := binary.BigEndian.Uint16(seg.data[2:4])
+	chunk := seg.data[FragmentHeaderSize:]
+
+	if index == 0 {
+		r.dropPartial(peer)
+		peer.partial = &reassembly{count: count}
+	}
+	partial := peer.partial
+	if partial == nil || count == 0 || index != partial.next || count != partial.count {
+		r.dropPartial(peer)
+		return nil, false
+	}
+	if len(partial.data)+len(chunk) > MaxMessageSize ||
+		r.reassemblyBytes+len(chunk) > ReassemblyBufferSize {
+		r.dropPartial(peer)
+		return nil, false
+	}
+
+	partial.data = append(partial.data, chunk...)
+	partial.next++
+	partial.lastSeen = now
+	r.reassemblyBytes += len(chunk)
+
+	if partial.next < partial.count {
+		return nil, false
+	}
+	r.reassemblyBytes -= len(partial.data)
+	peer.partial = nil
+	return partial.data, true
+}
+
+// dropPartial discards peer's partially reassembled message, if any.
+// Caller must hold r.mu.
+func (r *receiverState) dropPartial(peer *peerState) {
+	if peer.partial == nil {
+		return
+	}
+	r.reassemblyBytes -= len(peer.partial.data)
+	peer.partial = nil
+
+	r.stats.add(func(s *Statistics) { s.reassemblyFailures++ })
+}
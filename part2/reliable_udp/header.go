@@ -0,0 +1,205 @@
+package reliable_udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Wire header layout (big endian, HeaderSize bytes):
+//
+//	0      2       3     4       6        8                16          24         28
+//	| magic | version | type | flags | length | sequence number | timestamp | checksum |
+//
+// The payload of length bytes follows immediately after the header. The
+// checksum covers the header and the payload, with the checksum field
+// taken as zero.
+const (
+	HeaderMagic   uint16 = 0x5255 // "RU"
+	HeaderVersion uint8  = 2
+	HeaderSize           = 28
+
+	checksumOffset = 24
+)
+
+// PacketType identifies what a datagram carries
+type PacketType uint8
+
+const (
+	PacketData PacketType = iota + 1
+	PacketAck
+	PacketSyn
+	PacketSynAck
+	PacketFin
+	PacketReset
+	PacketPing
+	PacketNack
+	PacketParity
+	PacketProbe
+	PacketProbeAck
+	PacketResync
+)
+
+func (t PacketType) String() string {
+	switch t {
+	case PacketData:
+		return "DATA"
+	case PacketAck:
+		return "ACK"
+	case PacketSyn:
+		return "SYN"
+	case PacketSynAck:
+		return "SYN-ACK"
+	case PacketFin:
+		return "FIN"
+	case PacketReset:
+		return "RST"
+	case PacketPing:
+		return "PING"
+	case PacketNack:
+		return "NACK"
+	case PacketParity:
+		return "PARITY"
+	case PacketProbe:
+		return "PROBE"
+	case PacketProbeAck:
+		return "PROBE-ACK"
+	case PacketResync:
+		return "RESYNC"
+	default:
+		return fmt.Sprintf("PacketType(%d)", uint8(t))
+	}
+}
+
+// Header flags
+const (
+	// FlagResync marks a data packet whose sender has nothing unacknowledged
+	// below it, so the receiver may skip any gap in front of it
+	FlagResync uint16 = 1 << iota
+	// FlagGoBackN asks the receiver to discard out-of-order packets and
+	// answer with cumulative ACKs
+	FlagGoBackN
+	// FlagFragment marks a packet carrying one fragment of a larger message;
+	// its payload starts with the fragment index and count
+	FlagFragment
+	// FlagWindow marks an ACK whose payload carries the receiver's free
+	// buffer space
+	FlagWindow
+	// FlagSack on a Go-Back-N data packet asks the receiver to buffer
+	// out-of-order packets and report them; on an ACK it marks SACK ranges
+	// in the payload
+	FlagSack
+	// FlagAckDelay marks an ACK whose payload reports how long the receiver
+	// held it back
+	FlagAckDelay
+	// FlagCumulative marks an ACK that covers every packet up to its
+	// sequence number, whatever the sender's mode
+	FlagCumulative
+	// FlagEncrypted marks a packet whose payload is sealed with the
+	// connection's key
+	FlagEncrypted
+	// FlagKeyPhase on an encrypted packet is the parity of the session key
+	// generation it was sealed with
+	FlagKeyPhase
+	// FlagCompressed marks the packets of a message that was compressed
+	// with the connection's negotiated compressor
+	FlagCompressed
+	// FlagFEC marks a data packet covered by a parity packet
+	FlagFEC
+	// FlagNack on a data packet asks the receiver to report gaps in front
+	// of it with NACKs, because the sender fast retransmits
+	FlagNack
+)
+
+var (
+	ErrShortPacket        = errors.New("packet shorter than header")
+	ErrBadMagic           = errors.New("bad header magic")
+	ErrUnsupportedVersion = errors.New("unsupported header version")
+	ErrLengthMismatch     = errors.New("payload length does not match header")
+)
+
+// Header is the fixed-size prefix of every reliable_udp datagram
+type Header struct {
+	Version        uint8
+	Type           PacketType
+	Flags          uint16
+	SequenceNumber int64
+	Timestamp      time.Time
+	PayloadLength  uint16
+	Checksum       uint32
+}
+
+// EncodeHeader writes h into the first HeaderSize bytes of buf.
+// The version field is always written as HeaderVersion, and the checksum
+// as h.Checksum; EncodePacket fills it in.
+func EncodeHeader(buf []byte, h Header) {
+	binary.BigEndian.PutUint16(buf[0:2], HeaderMagic)
+	buf[2] = HeaderVersion
+	buf[3] = uint8(h.Type)
+	binary.BigEndian.PutUint16(buf[4:6], h.Flags)
+	binary.BigEndian.PutUint16(buf[6:8], h.PayloadLength)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(h.SequenceNumber))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(h.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(buf[24:28], h.Checksum)
+}
+
+// DecodeHeader parses and validates the header at the start of buf
+func DecodeHeader(buf []byte) (Header, error) {
+	if len(buf) < HeaderSize {
+		return Header{}, ErrShortPacket
+	}
+	if binary.BigEndian.Uint16(buf[0:2]) != HeaderMagic {
+		return Header{}, ErrBadMagic
+	}
+	if buf[2] != HeaderVersion {
+		return Header{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, buf[2])
+	}
+
+	return Header{
+		Version:        buf[2],
+		Type:           PacketType(buf[3]),
+		Flags:          binary.BigEndian.Uint16(buf[4:6]),
+		PayloadLength:  binary.BigEndian.Uint16(buf[6:8]),
+		SequenceNumber: int64(binary.BigEndian.Uint64(buf[8:16])),
+		Timestamp:      time.Unix(0, int64(binary.BigEndian.Uint64(buf[16:24]))),
+		Checksum:       binary.BigEndian.Uint32(buf[24:28]),
+	}, nil
+}
+
+// EncodePacket serializes a header followed by payload into a single datagram.
+// The header's PayloadLength is taken from len(payload) and its Checksum is
+// the CRC32C of the result.
+func EncodePacket(h Header, payload []byte) []byte {
+	h.PayloadLength = uint16(len(payload))
+	h.Checksum = 0
+	buf := make([]byte, HeaderSize+len(payload))
+	EncodeHeader(buf, h)
+	copy(buf[HeaderSize:], payload)
+	binary.BigEndian.PutUint32(buf[checksumOffset:], ChecksumCRC32C.sum(buf))
+	return buf
+}
+
+// DecodePacket splits a datagram into its header and payload. A datagram
+// whose contents do not match its CRC32C checksum is rejected with
+// ErrChecksumMismatch.
+func DecodePacket(buf []byte) (Header, []byte, error) {
+	return decodePacket(buf, ChecksumCRC32C)
+}
+
+// decodePacket is DecodePacket for a datagram whose checksum was computed
+// by alg
+func decodePacket(buf []byte, alg Checksum) (Header, []byte, error) {
+	h, err := DecodeHeader(buf)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	if len(buf)-HeaderSize != int(h.PayloadLength) {
+		return Header{}, nil, fmt.Errorf("%w: header says %d, got %d",
+			ErrLengthMismatch, h.PayloadLength, len(buf)-HeaderSize)
+	}
+	if !alg.verify(buf, h) {
+		return Header{}, nil, ErrChecksumMismatch
+	}
+	return h, buf[HeaderSize:], nil
+}
@@ -0,0 +1,230 @@
+package reliable_udp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key exchange
+//
+// With Config.KeyExchange the SYN carries the dialer's ephemeral X25519
+// public key and the SYN-ACK the listener's. With Config.Identity, each is
+// followed by the sender's Ed25519 public key and a signature over the key
+// and the handshake so far. SYN and SYN-ACK are sealed with Config.Key if
+// one is set.
+//
+// Both sides then derive a key per direction with HKDF-SHA256 from the
+// shared secret, salted with Config.Key and bound to both ISNs and public
+// keys, and forget their ephemeral private key. Everything after the
+// SYN-ACK is sealed with the session keys, starting with the dialer's ACK,
+// which proves it derived the same keys.
+
+const (
+	kexPublicSize = 32
+	identitySize  = ed25519.PublicKeySize + ed25519.SignatureSize
+)
+
+var (
+	errKeyExchangeUnsupported = errors.New("key exchange needs a connection; use Dial and Listen")
+	errNoSessionKey           = errors.New("no session key yet")
+)
+
+// keyExchange is our side of one X25519 exchange
+type keyExchange struct {
+	cfg  Config
+	priv *ecdh.PrivateKey
+}
+
+// checkKeyExchange reports why cfg cannot run a key exchange, if it cannot
+func checkKeyExchange(cfg Config) error {
+	if cfg.Cipher == CipherNone {
+		return errors.New("key exchange needs a cipher")
+	}
+	if len(cfg.Key) != 0 && len(cfg.Key) != KeySize {
+		return fmt.Errorf("invalid key: %d bytes, want %d", len(cfg.Key), KeySize)
+	}
+	if cfg.Identity != nil && len(cfg.Identity) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid identity: %d bytes, want %d", len(cfg.Identity), ed25519.PrivateKeySize)
+	}
+	if cfg.Identity != nil && len(cfg.TrustedPeers) == 0 {
+		return errors.New("identity given without trusted peers")
+	}
+	if len(cfg.Key) == 0 && cfg.Identity == nil {
+		return errors.New("key exchange needs a key or an identity to authenticate it")
+	}
+	return nil
+}
+
+// newHandshakeCrypto returns the protection of a connection until its
+// handshake completes. Without key exchange that is the static key for the
+// whole connection; with it, a session without keys yet that seals SYN and
+// SYN-ACK with cfg.Key, if any, and nothing else.
+func newHandshakeCrypto(cfg Config) (*packetCrypto, error) {
+	if !cfg.KeyExchange {
+		return newPacketCrypto(cfg)
+	}
+	if err := checkKeyExchange(cfg); err != nil {
+		return nil, err
+	}
+
+	var handshake *packetCrypto
+	if len(cfg.Key) != 0 {
+		static := cfg
+		static.KeyExchange = false
+		var err error
+		if handshake, err = newPacketCrypto(static); err != nil {
+			return nil, err
+		}
+	}
+	pc, err := newCrypto()
+	if err != nil {
+		return nil, err
+	}
+	pc.session = true
+	pc.handshake = handshake
+	return pc, nil
+}
+
+func newKeyExchange(cfg Config) (*keyExchange, error) {
+	priv, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	return &keyExchange{cfg: cfg, priv: priv}, nil
+}
+
+// hello returns our half of the exchange for a SYN or SYN-ACK, signed
+// together with label and context if we have an identity
+func (kx *keyExchange) hello(label string, context []byte) []byte {
+	msg := kx.priv.PublicKey().Bytes()
+	if kx.cfg.Identity == nil {
+		return msg
+	}
+	sig := ed25519.Sign(kx.cfg.Identity, concat([]byte(label), context, msg))
+	msg = append(msg, kx.cfg.Identity.Public().(ed25519.PublicKey)...)
+	return append(msg, sig...)
+}
+
+// parseHello checks the peer's half of the exchange and returns its public
+// key. With an identity, the peer's must be trusted and its signature valid.
+func (kx *keyExchange) parseHello(label string, context, msg []byte) (*ecdh.PublicKey, bool) {
+	if len(msg) != helloSize(kx.cfg) {
+		return nil, false
+	}
+
+	if kx.cfg.Identity != nil {
+		id := ed25519.PublicKey(msg[kexPublicSize : kexPublicSize+ed25519.PublicKeySize])
+		if !kx.trusted(id) {
+			return nil, false
+		}
+		signed := concat([]byte(label), context, msg[:kexPublicSize])
+		if !ed25519.Verify(id, signed, msg[kexPublicSize+ed25519.PublicKeySize:]) {
+			return nil, false
+		}
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(msg[:kexPublicSize])
+	if err != nil {
+		return nil, false
+	}
+	return pub, true
+}
+
+// trusted reports whether id is one of the configured trusted peers
+func (kx *keyExchange) trusted(id ed25519.PublicKey) bool {
+	for _, peer := range kx.cfg.TrustedPeers {
+		if bytes.Equal(peer, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// session derives the session keys shared with peer and forgets our
+// private key. transcript binds the keys to the handshake; handshake
+// protects the session's SYN and SYN-ACK.
+func (kx *keyExchange) session(peer *ecdh.PublicKey, transcript []byte, dialer bool, handshake *packetCrypto, st *Statistics) (*packetCrypto, error) {
+	shared, err := kx.priv.ECDH(peer)
+	kx.priv = nil
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %v", err)
+	}
+
+	keys := make([]byte, 2*KeySize)
+	r := hkdf.New(sha256.New, shared, kx.cfg.Key, concat([]byte("reliable_udp session keys"), transcript))
+	if _, err := io.ReadFull(r, keys); err != nil {
+		return nil, fmt.Errorf("failed to derive keys: %v", err)
+	}
+	// The first key protects what the dialer sends
+	sendSecret, recvSecret := keys[:KeySize], keys[KeySize:]
+	if !dialer {
+		sendSecret, recvSecret = recvSecret, sendSecret
+	}
+
+	send, err := newTrafficKey(kx.cfg.Cipher, sendSecret, false)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newTrafficKey(kx.cfg.Cipher, recvSecret, false)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := newCrypto()
+	if err != nil {
+		return nil, err
+	}
+	pc.session = true
+	pc.handshake = handshake
+	pc.rekeyPackets = kx.cfg.RekeyPackets
+	pc.rekeyBytes = kx.cfg.RekeyBytes
+	pc.stats = st
+	pc.send, pc.recv = send, recv
+	return pc, nil
+}
+
+// helloSize is the length of our and the peer's half of the key exchange
+// in a SYN or SYN-ACK
+func helloSize(cfg Config) int {
+	switch {
+	case !cfg.KeyExchange:
+		return 0
+	case cfg.Identity != nil:
+		return kexPublicSize + identitySize
+	default:
+		return kexPublicSize
+	}
+}
+
+// isnBytes encodes initial sequence numbers for a handshake transcript
+func isnBytes(isns ...int64) []byte {
+	b := make([]byte, 8*len(isns))
+	for i, isn := range isns {
+		binary.BigEndian.PutUint64(b[8*i:], uint64(isn))
+	}
+	return b
+}
+
+// framed prefixes b with its length, so that a compressor offer, which is
+// empty when nothing is offered, is signed and bound to the session keys
+// unambiguously
+func framed(b []byte) []byte {
+	return append([]byte{byte(len(b))}, b...)
+}
+
+// concat returns the parts joined into a new slice
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
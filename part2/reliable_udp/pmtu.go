@@ -0,0 +1,281 @@
+package reliable_udp
+
+import (
+	"net"
+	"time"
+)
+
+// Path MTU discovery
+//
+// With Config.PathMTUDiscovery the socket sets the DF bit, so that a
+// datagram too large for the path is dropped instead of fragmented, and the
+// sender searches for the largest datagram that gets through. A probe is a
+// PROBE packet padded to the size under test, which the peer answers with a
+// PROBE-ACK. Sizes are tried in a binary search between the largest one
+// confirmed and the smallest one known to fail; a size whose probe goes
+// unanswered pmtuProbeAttempts times, or that the kernel refuses to send,
+// counts as too large. Until a larger size is confirmed, packets carry
+// MaxPacketSize bytes.
+//
+// The search is repeated every PMTUProbeInterval in case the path grew. If
+// a packet larger than MaxPacketSize times out twice, the path may have
+// started to drop it: the confirmed size is probed again, and only if
+// pmtuValidateAttempts probes in a row go unanswered, so that ordinary loss
+// is not taken for a black hole, do packets fall back to MaxPacketSize and
+// the search starts over. The kernel refusing a packet or probe as too
+// large, even one queued for a batched write, shrinks packets at once.
+// Packets already sent keep their size.
+
+const (
+	// maxDatagramSize is the largest UDP payload over IPv4, and the size of
+	// receive buffers
+	maxDatagramSize = 65507
+
+	pmtuProbeAttempts = 3
+	// pmtuValidateAttempts is how many probes of the confirmed size must go
+	// unanswered in a row before it counts as a black hole
+	pmtuValidateAttempts = 6
+	// pmtuProbeTimeout is the shortest time to wait for a PROBE-ACK
+	pmtuProbeTimeout = 100 * time.Millisecond
+	// pmtuResolution ends a search once the largest confirmed and the
+	// smallest failed size are this close
+	pmtuResolution = 16
+)
+
+// pmtuState is a sender's path MTU search
+type pmtuState struct {
+	enabled    bool
+	ipOverhead int  // IP and UDP header bytes in front of a datagram
+	overhead   int  // datagram bytes around the payload of the largest packet
+	sealed     bool // datagrams are encrypted, adding sealOverhead bytes
+
+	size       int   // largest datagram confirmed to get through
+	lo, hi     int   // search range: lo confirmed, hi not known to fail
+	probe      int   // size of the outstanding probe, 0 if none
+	probeSeq   int64 // identifies the outstanding probe in its PROBE-ACK
+	attempts   int
+	validating bool // probing size again after a suspected black hole
+	timer      *time.Timer
+}
+
+// startPMTU begins path MTU discovery on a socket that sets the DF bit.
+// remote is the peer's address and sealed tells whether datagrams are
+// encrypted, which both add to the bytes around a payload.
+func (w *sendWindow) startPMTU(remote *net.UDPAddr, sealed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pmtu.enabled {
+		return
+	}
+	p := &w.pmtu
+	p.enabled = true
+	p.ipOverhead = 48 // IPv6 and UDP
+	if remote.IP.To4() != nil {
+		p.ipOverhead = 28
+	}
+	p.overhead = HeaderSize + fecHeaderSize
+	if sealed {
+		p.overhead += sealOverhead
+		p.sealed = true
+	}
+	w.pmtuConfirm(MaxPacketSize + p.overhead)
+	// Search from the timer, so that the caller's handshake finishes first
+	w.pmtuArm(0)
+}
+
+// packetSize returns the largest payload of a packet the sender sends
+func (w *sendWindow) packetSize() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.packetSizeLocked()
+}
+
+// packetSizeLocked is packetSize for callers that hold w.mu
+func (w *sendWindow) packetSizeLocked() int {
+	if !w.pmtu.enabled {
+		return MaxPacketSize
+	}
+	return w.pmtu.size - w.pmtu.overhead
+}
+
+// pmtuConfirm makes size the largest datagram known to get through.
+// Caller must hold w.mu.
+func (w *sendWindow) pmtuConfirm(size int) {
+	w.pmtu.size = size
+	w.stats.onPathMTU(size+w.pmtu.ipOverhead, w.packetSizeLocked())
+}
+
+// pmtuSearch starts a search upwards from the confirmed size.
+// Caller must hold w.mu.
+func (w *sendWindow) pmtuSearch() {
+	p := &w.pmtu
+	p.lo, p.hi = p.size, maxDatagramSize
+	p.validating = false
+	w.pmtuNext()
+}
+
+// pmtuNext probes the middle of the search range, or ends the search once
+// the range is narrow enough. Caller must hold w.mu.
+func (w *sendWindow) pmtuNext() {
+	p := &w.pmtu
+	if p.hi-p.lo < pmtuResolution {
+		p.probe = 0
+		w.pmtuArm(w.cfg.PMTUProbeInterval)
+		return
+	}
+	w.pmtuProbe((p.lo + p.hi + 1) / 2)
+}
+
+// pmtuProbe starts probing size. Caller must hold w.mu.
+func (w *sendWindow) pmtuProbe(size int) {
+	p := &w.pmtu
+	p.probe = size
+	p.probeSeq++
+	p.attempts = 0
+	w.pmtuSend()
+}
+
+// pmtuSend sends the outstanding probe, padded so that the datagram is
+// exactly the size under test. Caller must hold w.mu.
+func (w *sendWindow) pmtuSend() {
+	p := &w.pmtu
+	p.attempts++
+	padding := make([]byte, p.probe-p.overhead+fecHeaderSize)
+	err := w.write(EncodePacket(Header{
+		Type:           PacketProbe,
+		SequenceNumber: p.probeSeq,
+		Timestamp:      time.Now(),
+	}, padding))
+	if isMessageTooLong(err) {
+		// Larger than the local interface allows
+		w.pmtuFailed()
+		return
+	}
+	w.stats.onMTUProbe()
+
+	timeout := w.rtt.RTO()
+	if timeout < pmtuProbeTimeout {
+		timeout = pmtuProbeTimeout
+	}
+	w.pmtuArm(timeout)
+}
+
+// pmtuArm runs pmtuTimeout after d. Caller must hold w.mu.
+func (w *sendWindow) pmtuArm(d time.Duration) {
+	if w.pmtu.timer == nil {
+		w.pmtu.timer = time.AfterFunc(d, w.pmtuTimeout)
+		return
+	}
+	w.pmtu.timer.Reset(d)
+}
+
+// pmtuTimeout resends an unanswered probe, gives up on its size, or starts
+// the next periodic search
+func (w *sendWindow) pmtuTimeout() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p := &w.pmtu
+	switch {
+	case w.err != nil || w.closed:
+	case p.probe == 0:
+		w.pmtuSearch()
+	case p.attempts < pmtuProbeAttempts, p.validating && p.attempts < pmtuValidateAttempts:
+		w.pmtuSend()
+	default:
+		w.pmtuFailed()
+	}
+}
+
+// pmtuFailed records that the probed size does not get through.
+// Caller must hold w.mu.
+func (w *sendWindow) pmtuFailed() {
+	p := &w.pmtu
+	if p.validating {
+		// The confirmed size stopped getting through
+		w.stats.onMTUBlackHole()
+		w.pmtuConfirm(MaxPacketSize + p.overhead)
+		w.pmtuSearch()
+		return
+	}
+	p.hi = p.probe - 1
+	w.pmtuNext()
+}
+
+// handleProbeAck records that the probe seq got through
+func (w *sendWindow) handleProbeAck(seq int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p := &w.pmtu
+	if p.probe == 0 || seq != p.probeSeq || w.err != nil || w.closed {
+		return
+	}
+	if p.validating {
+		// A false alarm; resume the periodic searches
+		p.validating = false
+		p.probe = 0
+		w.pmtuArm(w.cfg.PMTUProbeInterval)
+		return
+	}
+	p.lo = p.probe
+	w.pmtuConfirm(p.probe)
+	w.pmtuNext()
+}
+
+// pmtuSuspect reacts to repeated timeouts of a packet with payload bytes
+// by probing the confirmed size again, unless the packet is no larger than
+// MaxPacketSize, or larger than what is confirmed now, or a probe is
+// already out. Caller must hold w.mu.
+func (w *sendWindow) pmtuSuspect(payload int) {
+	p := &w.pmtu
+	if !p.enabled || p.probe != 0 || payload <= MaxPacketSize || payload > w.packetSizeLocked() {
+		return
+	}
+	p.validating = true
+	w.pmtuProbe(p.size)
+}
+
+// datagramSize returns the size of the datagram that carries wire
+func (p *pmtuState) datagramSize(wire []byte) int {
+	if p.sealed {
+		return len(wire) + sealOverhead
+	}
+	return len(wire)
+}
+
+// pmtuRefused handles a datagram of size bytes that the kernel refused to
+// send because it was too large
+func (w *sendWindow) pmtuRefused(size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil && !w.closed {
+		w.pmtuRefusedLocked(size)
+	}
+}
+
+// pmtuRefusedLocked fails the outstanding probe if it was refused, or
+// falls back to MaxPacketSize if a packet that fits the confirmed size was.
+// Caller must hold w.mu.
+func (w *sendWindow) pmtuRefusedLocked(size int) {
+	p := &w.pmtu
+	switch {
+	case !p.enabled:
+	case p.probe != 0 && size == p.probe:
+		w.pmtuFailed()
+	case size > MaxPacketSize+p.overhead && size <= p.size:
+		w.stats.onMTUBlackHole()
+		w.pmtuConfirm(MaxPacketSize + p.overhead)
+		w.pmtuSearch()
+	}
+}
+
+// encodeProbeAck builds the answer to the probe h
+func encodeProbeAck(h Header) []byte {
+	return EncodePacket(Header{
+		Type:           PacketProbeAck,
+		SequenceNumber: h.SequenceNumber,
+		Timestamp:      time.Now(),
+	}, nil)
+}
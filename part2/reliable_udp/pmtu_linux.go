@@ -0,0 +1,36 @@
+package reliable_udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setDontFragment makes conn send datagrams with the DF bit set, ignoring
+// the path MTU the kernel learned, so that probes larger than it can be
+// sent
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to set DF: %v", err)
+	}
+	var err4, err6 error
+	if err := raw.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	}); err != nil {
+		return fmt.Errorf("failed to set DF: %v", err)
+	}
+	// An IPv4 socket rejects the IPv6 option and vice versa
+	if err4 != nil && err6 != nil {
+		return fmt.Errorf("failed to set DF: %v", err4)
+	}
+	return nil
+}
+
+// isMessageTooLong reports whether a send failed because the datagram
+// exceeds the MTU of the outgoing interface
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
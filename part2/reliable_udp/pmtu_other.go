@@ -0,0 +1,20 @@
+//go:build !linux
+
+package reliable_udp
+
+import (
+	"errors"
+	"net"
+)
+
+var errDontFragmentUnsupported = errors.New("setting DF is only supported on Linux")
+
+// setDontFragment is not supported here; packets stay at MaxPacketSize
+func setDontFragment(conn *net.UDPConn) error {
+	return errDontFragmentUnsupported
+}
+
+// isMessageTooLong is never true, since probes are never sent
+func isMessageTooLong(err error) bool {
+	return false
+}
@@ -1,6 +1,8 @@
 package reliable_udp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
@@ -10,7 +12,9 @@ import (
 )
 
 const (
-	MaxRetries    = 5
+	MaxRetries = 5
+	// RetryTimeout is the retransmission timeout used until the first RTT
+	// sample is available; afterwards the RTO adapts to the measured RTT
 	RetryTimeout  = 100 * time.Millisecond
 	MaxPacketSize = 1024
 	ACK           = "ACK"
@@ -18,145 +22,413 @@ const (
 
 type Packet struct {
 	SequenceNumber int64
+	Flags          uint16
 	Data           []byte
 	Timestamp      time.Time
 }
 
+// Statistics holds the counters of one connection or socket. The
+// package-level stats variable aggregates all of them.
 type Statistics struct {
-	mu             sync.Mutex
-	sentPackets    int
-	recvPackets    int
-	lostPackets    int
-	droppedPackets int // New field for tracking initially dropped packets
-	totalRTT       time.Duration
-	dropRate       float64
+	mu                 sync.Mutex
+	sentPackets        int
+	recvPackets        int
+	lostPackets        int
+	droppedPackets     int // New field for tracking initially dropped packets
+	duplicatePackets   int
+	retransmissions    map[Mode]int
+	fastRetransmits    int
+	reassemblyFailures int
+	bytesSent          int64
+	bytesAcked         int64
+	rttSamples         int
+	totalRTT           time.Duration
+	minRTT             time.Duration
+	maxRTT             time.Duration
+	srtt               time.Duration
+	rto                time.Duration
+	firstSent          time.Time
+	lastAcked          time.Time
+	windowStalled      time.Duration
+	zeroWindowProbes   int
+	corruptPackets     int
+	acksSent           int
+	sackAvoided        int
+	authFailures       int
+	replayedPackets    int
+	keyUpdates         int
+	compressedMsgs     int
+	compressionSkipped int
+	compressionIn      int64
+	compressionOut     int64
+	compressTime       time.Duration
+	decompressTime     time.Duration
+	parityPackets      int
+	parityBytes        int64
+	fecRecovered       int
+	pathMTU            int
+	packetSize         int
+	mtuProbes          int
+	mtuBlackHoles      int
+	dropRate           float64 // only used on the aggregate
+	corruptRate        float64 // only used on the aggregate
 }
 
 // GetStatistics returns a copy of the statistics without the mutex
 type StatisticsCopy struct {
-	SentPackets    int
-	RecvPackets    int
-	LostPackets    int
-	DroppedPackets int
-	TotalRTT       time.Duration
-	DropRate       float64
+	SentPackets        int
+	RecvPackets        int
+	LostPackets        int
+	DroppedPackets     int
+	DuplicatePackets   int          // data packets received more than once
+	Retransmits        int          // retransmitted packets in all modes
+	FastRetransmits    int          // retransmissions triggered by a NACK
+	TimeoutRetransmits int          // retransmissions triggered by a timer
+	Retransmissions    map[Mode]int // retransmitted packets per transmission mode
+	ReassemblyFailures int          // partially received messages that were discarded
+	BytesSent          int64        // payload bytes put on the wire, retransmissions included
+	BytesAcked         int64        // payload bytes acknowledged by the peer
+	Goodput            float64      // acknowledged payload bytes per second
+	TotalRTT           time.Duration
+	MinRTT             time.Duration
+	AvgRTT             time.Duration
+	MaxRTT             time.Duration
+	SRTT               time.Duration // smoothed RTT of the most recent estimate
+	RTO                time.Duration // retransmission timeout of the most recent estimate
+	WindowStalled      time.Duration // time senders waited for the peer's receive window
+	ZeroWindowProbes   int           // packets sent into a zero receive window to probe it
+	CorruptPackets     int           // received datagrams discarded for a bad checksum
+	AcksSent           int           // ACK datagrams sent for data packets
+	SackAvoided        int           // Go-Back-N retransmissions skipped because SACK showed the packet arrived
+	AuthFailures       int           // received datagrams that failed decryption or lacked required encryption
+	ReplayedPackets    int           // authentic datagrams discarded because they were received before
+	KeyUpdates         int           // session keys this side replaced after RekeyPackets or RekeyBytes
+	CompressedMessages int           // messages sent compressed
+	CompressionSkipped int           // messages sent raw because they were small or incompressible
+	CompressionRatio   float64       // original size over compressed size of the compressed messages
+	CompressTime       time.Duration // time spent compressing, skipped attempts included
+	DecompressTime     time.Duration // time spent decompressing
+	ParityPackets      int           // FEC parity packets sent
+	ParityBytes        int64         // parity payload bytes sent
+	FECOverhead        float64       // parity bytes over data bytes sent
+	FECRecovered       int           // lost data packets rebuilt from parity
+	PathMTU            int           // largest IP packet path MTU discovery confirmed, 0 unless enabled
+	PacketSize         int           // payload bytes per packet chosen from PathMTU
+	MTUProbes          int           // path MTU probes sent
+	MTUBlackHoles      int           // times a confirmed path MTU stopped getting through
+	DropRate           float64
 }
 
+// GetStatistics returns the aggregate of all connections in the process
 func GetStatistics() StatisticsCopy {
-	stats.mu.Lock()
-	defer stats.mu.Unlock()
-
-	return StatisticsCopy{
-		SentPackets:    stats.sentPackets,
-		RecvPackets:    stats.recvPackets,
-		LostPackets:    stats.lostPackets,
-		DroppedPackets: stats.droppedPackets,
-		TotalRTT:       stats.totalRTT,
-		DropRate:       stats.dropRate,
-	}
+	return stats.snapshot()
 }
 
 var (
-	stats           = Statistics{}
-	currentSequence atomic.Int64
+	stats     = Statistics{retransmissions: make(map[Mode]int)}
+	endpoints sync.Map // *net.UDPConn -> *endpoint
 )
 
+// endpoint is the sender-side state SendReliable keeps for each socket
+type endpoint struct {
+	seq atomic.Int64
+
+	stats *Statistics
+
+	mu  sync.Mutex
+	cfg Config
+
+	crypto atomic.Pointer[packetCrypto] // nil unless Config.Cipher is set
+
+	queueMu     sync.Mutex
+	queue       []*asyncSend // messages waiting for SendAsync's goroutine
+	pending     int          // messages queued or in flight
+	sending     bool         // whether SendAsync's goroutine is running
+	reading     bool         // whether the ACK reader is running
+	window      *sendWindow  // engine the queued messages are sent with
+	reconfigure bool         // Configure ran while messages were pending
+}
+
+func endpointFor(conn *net.UDPConn) *endpoint {
+	if ep, ok := endpoints.Load(conn); ok {
+		return ep.(*endpoint)
+	}
+	cfg := DefaultConfig().normalize()
+	st := newStatistics()
+	fresh := &endpoint{
+		stats: st,
+		cfg:   cfg,
+	}
+	// A random start keeps a released or restarted socket from reusing
+	// sequence numbers its peers have already seen
+	fresh.seq.Store(rand.Int63n(1 << 32))
+	ep, _ := endpoints.LoadOrStore(conn, fresh)
+	return ep.(*endpoint)
+}
+
+// settings returns the endpoint's config
+func (ep *endpoint) settings() Config {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.cfg
+}
+
+// Configure sets the per-connection settings SendReliable, SendAsync and
+// ReceiveReliable use on conn, such as the window, the RTO clamps, the retry
+// policy and the packet encryption. Sends pick them up, with a fresh RTT
+// estimate, once the messages already queued are done. It fails if the
+// cipher cannot be set up with cfg.Key, leaving the settings unchanged.
+func Configure(conn *net.UDPConn, cfg Config) error {
+	cfg = cfg.normalize()
+	pc, err := newPacketCrypto(cfg)
+	if err != nil {
+		return err
+	}
+	ep := endpointFor(conn)
+
+	ep.mu.Lock()
+	ep.cfg = cfg
+	ep.crypto.Store(pc)
+	ep.mu.Unlock()
+
+	ep.queueMu.Lock()
+	if ep.pending == 0 {
+		ep.window = nil
+	} else {
+		ep.reconfigure = true
+	}
+	ep.queueMu.Unlock()
+
+	if r, ok := receivers.Load(conn); ok {
+		r.(*receiverState).configure(cfg)
+		r.(*receiverState).forgetIdlePeers(cfg.IdleTimeout)
+	}
+	return nil
+}
+
+// Release forgets the state this package keeps for conn: its sequence
+// numbers, settings, RTT estimate, receive buffers, per-sender ordering and
+// statistics. Call it once conn is no longer used with SendReliable,
+// ReceiveReliable or a WindowSender, typically right before closing it.
+// Messages received but not read yet are discarded. The aggregate
+// statistics keep what conn contributed.
+//
+// Using conn with this package again starts from scratch, at a new random
+// sequence number, so that its peers resync to it instead of taking its
+// messages for duplicates of earlier ones.
+func Release(conn *net.UDPConn) {
+	if r, ok := receivers.LoadAndDelete(conn); ok {
+		r.(*receiverState).release()
+	}
+	endpoints.Delete(conn)
+}
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// createPacket creates a new packet with sequence number and timestamp
-func createPacket(data []byte) Packet {
-	return Packet{
-		SequenceNumber: currentSequence.Add(1),
-		Data:           data,
-		Timestamp:      time.Now(),
-	}
+// nextSequence allocates the next sequence number in conn's sequence space.
+// Each socket numbers its packets independently so that a receiver sees a
+// contiguous sequence from every sender.
+func nextSequence(conn *net.UDPConn) int64 {
+	return endpointFor(conn).seq.Add(1)
 }
 
-// validatePacket checks if the packet size is within limits
-func validatePacket(data []byte) bool {
-	return len(data) <= MaxPacketSize
+// encode serializes the packet as a datagram of the given type
+func (p Packet) encode(typ PacketType) []byte {
+	return EncodePacket(Header{
+		Type:           typ,
+		Flags:          p.Flags,
+		SequenceNumber: p.SequenceNumber,
+		Timestamp:      p.Timestamp,
+	}, p.Data)
 }
 
-// SendReliable sends data with retry mechanism
+// SendReliable sends data with retry mechanism, using the retry policy
+// configured for conn. It waits behind messages queued with SendAsync.
 func SendReliable(conn *net.UDPConn, data string) (time.Duration, error) {
-	if !validatePacket([]byte(data)) {
-		return 0, fmt.Errorf("packet size exceeds maximum allowed size of %d bytes", MaxPacketSize)
+	return SendAsync(conn, data).Wait()
+}
+
+// SendReliableContext is like SendReliable but stops retrying as soon as ctx
+// is cancelled or its deadline passes. The error then wraps ctx.Err() and
+// reports how many transmission attempts were made.
+func SendReliableContext(ctx context.Context, conn *net.UDPConn, data string) (time.Duration, error) {
+	return SendAsyncContext(ctx, conn, data).Wait()
+}
+
+// SendReliableWithPolicy sends data with retry mechanism, using policy for
+// this send instead of the connection's retry policy. Messages larger than
+// MaxPacketSize are split into fragments that are each sent reliably; the
+// returned duration covers the whole message.
+func SendReliableWithPolicy(conn *net.UDPConn, data string, policy RetryPolicy) (time.Duration, error) {
+	return sendAsync(context.Background(), conn, data, policy).Wait()
+}
+
+// ReceiveReliable handles incoming packets and sends ACKs.
+// Every data packet is acknowledged, but messages are returned to the caller
+// exactly once and in sequence order per sender: retransmissions are dropped
+// and packets that arrive ahead of a gap are buffered until it fills.
+// Fragmented messages are returned once all their fragments have arrived.
+func ReceiveReliable(conn *net.UDPConn) ([]byte, *net.UDPAddr, error) {
+	return receiveReliable(context.Background(), conn)
+}
+
+// ReceiveReliableContext is like ReceiveReliable but returns once ctx is
+// cancelled or its deadline passes, with an error wrapping ctx.Err(). It
+// manages conn's read deadline itself and clears it before returning.
+func ReceiveReliableContext(ctx context.Context, conn *net.UDPConn) ([]byte, *net.UDPAddr, error) {
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(d)
 	}
+	stop := watchContext(ctx, conn)
+	defer conn.SetReadDeadline(time.Time{})
+	defer stop()
 
-	packet := createPacket([]byte(data))
-	start := time.Now()
-	ackBuf := make([]byte, MaxPacketSize)
+	data, addr, err := receiveReliable(ctx, conn)
+	if err != nil {
+		if ctxErr := contextErr(ctx); ctxErr != nil {
+			return nil, nil, fmt.Errorf("receive abandoned: %w", ctxErr)
+		}
+	}
+	return data, addr, err
+}
 
-	stats.mu.Lock()
-	stats.sentPackets++
-	stats.mu.Unlock()
+func receiveReliable(ctx context.Context, conn *net.UDPConn) ([]byte, *net.UDPAddr, error) {
+	r := receiverFor(conn)
+	if d, ok := r.pop(); ok {
+		return d.data, d.addr, nil
+	}
 
-	for retry := 0; retry < MaxRetries; retry++ {
-		// Send packet
-		if _, err := conn.Write(packet.Data); err != nil {
-			return 0, fmt.Errorf("send error: %v", err)
+	ep := endpointFor(conn)
+	pc, alg := ep.crypto.Load(), ep.settings().Checksum
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		if err := contextErr(ctx); err != nil {
+			return nil, nil, err
+		}
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read error: %v", err)
 		}
 
-		// Wait for ACK with timeout
-		conn.SetReadDeadline(time.Now().Add(RetryTimeout))
-		n, _, err := conn.ReadFrom(ackBuf)
+		header, payload, err := decodeReceived(buffer[:n], alg, r.stats, pc)
+		if errors.Is(err, ErrChecksumMismatch) {
+			// Not ACKed, so the sender retransmits it
+			continue
+		}
+		if errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrReplay) {
+			// Forged, or a copy of a packet that was already ACKed
+			continue
+		}
+		if err != nil {
+			return nil, addr, fmt.Errorf("decode error: %v", err)
+		}
+		if header.Type == PacketProbe {
+			r.write(addr, encodeProbeAck(header))
+			continue
+		}
+		if header.Type != PacketData && header.Type != PacketParity {
+			return nil, addr, fmt.Errorf("unexpected %v packet", header.Type)
+		}
 
-		if err == nil && string(ackBuf[:n]) == ACK {
-			rtt := time.Since(start)
+		if artificialDrop(r.stats) {
+			return nil, nil, fmt.Errorf("packet dropped (artificial loss)")
+		}
 
-			stats.mu.Lock()
-			stats.recvPackets++
-			stats.totalRTT += rtt
-			stats.mu.Unlock()
+		if header.Type == PacketParity {
+			r.addParity(addr, header, payload)
+			r.recoverLost(addr)
+			if d, ok := r.pop(); ok {
+				return d.data, d.addr, nil
+			}
+			continue
+		}
+
+		result, ack := r.accept(addr, header, payload)
+		if result == acceptUnsynced {
+			r.requestResync(addr, header)
+			continue
+		}
+		if ack == 0 {
+			// Not ACKed, so the sender retransmits it later
+			continue
+		}
 
-			return rtt, nil
+		if result == acceptDuplicate {
+			r.stats.onDuplicate()
 		}
 
-		if retry < MaxRetries-1 {
-			stats.mu.Lock()
-			stats.droppedPackets++
-			stats.mu.Unlock()
+		// Take the message before ACKing, so the window includes its space
+		d, ok := r.pop()
 
-			fmt.Printf("Retry %d: packet %d (size: %d bytes)\n",
-				retry+1, packet.SequenceNumber, len(packet.Data))
+		// Send ACK
+		if err := r.acknowledge(addr, header, ack, result); err != nil {
+			return nil, nil, fmt.Errorf("failed to send ACK: %v", err)
+		}
+		if header.Flags&FlagFEC != 0 {
+			// The packet may have completed a parity group
+			r.recoverLost(addr)
+			if !ok {
+				d, ok = r.pop()
+			}
+		}
+
+		if ok {
+			return d.data, d.addr, nil
 		}
 	}
+}
 
-	stats.mu.Lock()
-	stats.lostPackets++
-	stats.mu.Unlock()
+// watchContext interrupts reads blocked on conn once ctx is done. The
+// returned function stops watching and must be called before returning.
+func watchContext(ctx context.Context, conn *net.UDPConn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
 
-	return 0, fmt.Errorf("max retries exceeded for packet %d", packet.SequenceNumber)
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
 }
 
-// ReceiveReliable handles incoming packets and sends ACKs
-func ReceiveReliable(conn *net.UDPConn) ([]byte, *net.UDPAddr, error) {
-	buffer := make([]byte, MaxPacketSize)
-	n, addr, err := conn.ReadFromUDP(buffer)
-	if err != nil {
-		return nil, nil, fmt.Errorf("read error: %v", err)
+// contextErr is ctx.Err(), but already reports context.DeadlineExceeded
+// when a read deadline taken from ctx fired just before ctx's own timer
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
 	}
+	return nil
+}
 
+// artificialDrop counts a received data packet in st and decides whether
+// the receiver should drop it to simulate loss at the configured drop rate
+func artificialDrop(st *Statistics) bool {
 	stats.mu.Lock()
-	stats.recvPackets++
-	shouldDrop := (stats.dropRate > 0 && rand.Float64()*100 < stats.dropRate)
+	drop := stats.dropRate > 0 && rand.Float64()*100 < stats.dropRate
 	stats.mu.Unlock()
 
-	if shouldDrop {
-		stats.mu.Lock()
-		stats.lostPackets++
-		stats.mu.Unlock()
-		return nil, nil, fmt.Errorf("packet dropped (artificial loss)")
-	}
-
-	// Send ACK
-	if _, err := conn.WriteToUDP([]byte(ACK), addr); err != nil {
-		return nil, nil, fmt.Errorf("failed to send ACK: %v", err)
-	}
-
-	return buffer[:n], addr, nil
+	st.add(func(s *Statistics) {
+		s.recvPackets++
+		if drop {
+			s.lostPackets++
+		}
+	})
+	return drop
 }
 
 // SetDropRate sets artificial packet loss rate (0-100)
@@ -172,12 +444,12 @@ func SetDropRate(rate float64) {
 	}
 }
 
-// ResetStatistics resets all statistics counters
+// ResetStatistics resets the aggregate counters and the drop and
+// corruption rates. Per-connection statistics are left alone.
 func ResetStatistics() {
 	stats.mu.Lock()
 	defer stats.mu.Unlock()
-	stats.sentPackets = 0
-	stats.recvPackets = 0
-	stats.lostPackets = 0
-	stats.totalRTT = 0
+	stats.reset()
+	stats.dropRate = 0
+	stats.corruptRate = 0
 }
@@ -0,0 +1,483 @@
+package reliable_udp
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReorderBufferSize bounds how many out-of-order packets the receiver holds
+// per sender while waiting for a gap to fill
+const ReorderBufferSize = 1024
+
+type acceptResult int
+
+const (
+	acceptNew acceptResult = iota
+	acceptDuplicate
+	acceptOverflow
+	acceptOutOfOrder
+	acceptUnsynced // no state for the sender and no FlagResync to start from
+)
+
+// delivery is a message that is ready to be returned to the application
+type delivery struct {
+	data       []byte
+	addr       *net.UDPAddr
+	compressed bool // data must be decompressed with the connection's compressor
+}
+
+// segment is the payload of one data packet together with its header flags
+type segment struct {
+	flags uint16
+	data  []byte
+}
+
+// peerState puts the packets received from one sender back in order and
+// reassembles fragmented messages
+type peerState struct {
+	next          int64             // next in-order sequence number, 0 until known
+	buffered      map[int64]segment // out-of-order packets waiting for a gap to fill
+	bufferedBytes int               // payload bytes held in buffered
+	partial       *reassembly       // fragmented message being reassembled
+
+	lastHeard time.Time   // when the last data packet arrived
+	nackedTo  int64       // highest sequence number reported missing
+	unsynced  bool        // packets were buffered before the resync and not ACKed
+	unacked   int         // packets not yet ACKed under a delaying AckPolicy
+	heldSince time.Time   // when the first of the unacked packets arrived
+	ackTimer  *time.Timer // sends the held-back ACK
+
+	fecPackets map[int64]segment      // recent packets covered by parity, kept for recovery
+	parities   map[int64]*parityGroup // parity packets by the first sequence number of their group
+}
+
+func newPeerState() *peerState {
+	return &peerState{buffered: make(map[int64]segment)}
+}
+
+// accept processes a data packet and returns the payloads that became
+// deliverable, in sequence order, together with the sequence number to
+// acknowledge (0 for no ACK). Selective-repeat packets are ACKed
+// individually; Go-Back-N packets get a cumulative ACK of the last in-order
+// sequence number, and out-of-order ones are discarded instead of buffered
+// unless the sender asked for SACK.
+//
+// Without FlagResync, a packet from a sender whose position is unknown is
+// buffered but not ACKed: the receiver lost its state, for example because
+// the sender's session was reaped, or the packet overtook the one that
+// resyncs, and cannot tell yet where the sender's sequence resumes.
+func (p *peerState) accept(h Header, payload []byte) ([]segment, acceptResult, int64) {
+	seq := h.SequenceNumber
+	goBackN := h.Flags&FlagGoBackN != 0
+	sack := h.Flags&FlagSack != 0
+
+	var ready []segment
+	if h.Flags&FlagResync != 0 && (p.next == 0 || seq > p.next) {
+		ready = p.skipTo(seq)
+	}
+	if p.next == 0 {
+		if _, ok := p.buffered[seq]; !ok && len(p.buffered) < ReorderBufferSize {
+			p.buffered[seq] = segment{flags: h.Flags, data: append([]byte(nil), payload...)}
+			p.bufferedBytes += len(payload)
+			p.unsynced = true
+		}
+		return nil, acceptUnsynced, 0
+	}
+
+	ack := seq
+	if goBackN {
+		ack = p.next - 1
+		if ack < 0 {
+			ack = 0
+		}
+	}
+
+	if seq < p.next {
+		return ready, acceptDuplicate, ack
+	}
+	if _, ok := p.buffered[seq]; ok {
+		return ready, acceptDuplicate, ack
+	}
+
+	data := segment{flags: h.Flags, data: append([]byte(nil), payload...)}
+	if seq != p.next {
+		if goBackN && !sack {
+			return ready, acceptOutOfOrder, ack
+		}
+		if len(p.buffered) >= ReorderBufferSize {
+			return ready, acceptOverflow, 0
+		}
+		p.buffered[seq] = data
+		p.bufferedBytes += len(data.data)
+		return ready, acceptNew, ack
+	}
+
+	ready = append(ready, data)
+	p.next++
+	for {
+		data, ok := p.buffered[p.next]
+		if !ok {
+			break
+		}
+		ready = append(ready, data)
+		delete(p.buffered, p.next)
+		p.bufferedBytes -= len(data.data)
+		p.next++
+	}
+	if goBackN {
+		ack = p.next - 1
+	}
+	return ready, acceptNew, ack
+}
+
+// sackRanges returns up to MaxSackRanges ranges of buffered packets,
+// lowest first
+func (p *peerState) sackRanges() []sackRange {
+	if len(p.buffered) == 0 {
+		return nil
+	}
+	seqs := make([]int64, 0, len(p.buffered))
+	for s := range p.buffered {
+		seqs = append(seqs, s)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var ranges []sackRange
+	for _, s := range seqs {
+		if n := len(ranges); n > 0 && ranges[n-1].end == s-1 {
+			ranges[n-1].end = s
+			continue
+		}
+		if len(ranges) == MaxSackRanges {
+			break
+		}
+		ranges = append(ranges, sackRange{s, s})
+	}
+	return ranges
+}
+
+// newGaps returns up to MaxSackRanges ranges of sequence numbers missing
+// below seq that were not reported before, and marks them reported
+func (p *peerState) newGaps(seq int64) []sackRange {
+	if p.next == 0 {
+		return nil
+	}
+	from := p.next
+	if p.nackedTo >= from {
+		from = p.nackedTo + 1
+	}
+	if seq-from > MaxWindowSize {
+		from = seq - MaxWindowSize
+	}
+
+	var gaps []sackRange
+	for s := from; s < seq; s++ {
+		if _, ok := p.buffered[s]; ok {
+			continue
+		}
+		if n := len(gaps); n > 0 && gaps[n-1].end == s-1 {
+			gaps[n-1].end = s
+			continue
+		}
+		if len(gaps) == MaxSackRanges {
+			break
+		}
+		gaps = append(gaps, sackRange{s, s})
+	}
+	if n := len(gaps); n > 0 {
+		p.nackedTo = gaps[n-1].end
+	}
+	return gaps
+}
+
+// skipTo gives up on any gap below seq: buffered packets below it are
+// released in order and seq becomes the next expected sequence number.
+// Before the first resync, packets below seq were never ACKed and the sender
+// no longer has them outstanding, so they are dropped instead.
+func (p *peerState) skipTo(seq int64) []segment {
+	var below []int64
+	for s := range p.buffered {
+		if s < seq {
+			below = append(below, s)
+		}
+	}
+	sort.Slice(below, func(i, j int) bool { return below[i] < below[j] })
+
+	ready := make([]segment, 0, len(below))
+	for _, s := range below {
+		if p.next != 0 {
+			ready = append(ready, p.buffered[s])
+		}
+		p.bufferedBytes -= len(p.buffered[s].data)
+		delete(p.buffered, s)
+	}
+	if old, ok := p.buffered[seq]; ok {
+		// The packet that resyncs replaces its buffered copy
+		p.bufferedBytes -= len(old.data)
+		delete(p.buffered, seq)
+	}
+	p.next = seq
+	return ready
+}
+
+// receiverState tracks per-sender ordering for one listening socket and
+// queues messages that are ready for ReceiveReliable
+type receiverState struct {
+	mu    sync.Mutex
+	peers map[string]*peerState
+	ready []delivery
+
+	reassemblyBytes int // bytes held in partial messages across all peers
+	readyBytes      int // bytes queued in ready
+	bufferedBytes   int // bytes held out of order across all peers
+	capacity        int // receive buffer size advertised to senders
+
+	ackPolicy AckPolicy
+	ackEvery  int
+	ackDelay  time.Duration
+	write     func(addr *net.UDPAddr, b []byte) error // sends ACKs
+
+	peerTimeout time.Duration // forget senders silent this long; 0 keeps them
+	sweptAt     time.Time     // when idle senders were last looked for
+	sweepTimer  *time.Timer   // sweeps while no packets arrive
+	stopped     bool          // no timers may be started
+
+	stats *Statistics
+}
+
+var receivers sync.Map // *net.UDPConn -> *receiverState
+
+// newReceiverState creates a receiver that sends its ACKs with write
+func newReceiverState(cfg Config, st *Statistics, write func(*net.UDPAddr, []byte) error) *receiverState {
+	r := &receiverState{
+		peers: make(map[string]*peerState),
+		write: write,
+		stats: st,
+	}
+	r.configure(cfg)
+	return r
+}
+
+func receiverFor(conn *net.UDPConn) *receiverState {
+	if r, ok := receivers.Load(conn); ok {
+		return r.(*receiverState)
+	}
+	ep := endpointFor(conn)
+	cfg := ep.settings()
+	write := func(addr *net.UDPAddr, b []byte) error {
+		_, err := conn.WriteToUDP(ep.crypto.Load().seal(b, ep.settings().Checksum), addr)
+		return err
+	}
+	fresh := newReceiverState(cfg, ep.stats, write)
+	r, loaded := receivers.LoadOrStore(conn, fresh)
+	if !loaded {
+		fresh.forgetIdlePeers(cfg.IdleTimeout)
+	}
+	return r.(*receiverState)
+}
+
+// forgetIdlePeers makes the receiver drop the state of senders it has not
+// heard from for d, so that a socket receiving from ever new addresses does
+// not keep all of them. A sender that comes back is asked to resync. Zero or
+// negative keeps every sender.
+func (r *receiverState) forgetIdlePeers(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	r.peerTimeout = d
+	if d > 0 && r.sweepTimer == nil && !r.stopped {
+		r.sweepTimer = time.AfterFunc(d/4, r.sweepIdle)
+	}
+}
+
+// sweepIdle forgets idle senders from a timer, so that their state does not
+// wait for the next packet to be dropped
+func (r *receiverState) sweepIdle() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peerTimeout <= 0 {
+		r.sweepTimer = nil
+		return
+	}
+	r.sweepLocked(time.Now())
+	r.sweepTimer.Reset(r.peerTimeout / 4)
+}
+
+// sweepLocked forgets the senders that have been silent for peerTimeout,
+// looking for them at most every quarter of it. Caller must hold r.mu.
+func (r *receiverState) sweepLocked(now time.Time) {
+	if r.peerTimeout <= 0 || now.Sub(r.sweptAt) < r.peerTimeout/4 {
+		return
+	}
+	r.sweptAt = now
+	for key, peer := range r.peers {
+		if now.Sub(peer.lastHeard) > r.peerTimeout {
+			r.forgetLocked(key, peer)
+		}
+	}
+}
+
+// forgetLocked drops a sender's ordering, reassembly and ACK state.
+// Caller must hold r.mu.
+func (r *receiverState) forgetLocked(key string, peer *peerState) {
+	r.bufferedBytes -= peer.bufferedBytes
+	r.dropPartial(peer)
+	if peer.ackTimer != nil {
+		peer.ackTimer.Stop()
+	}
+	delete(r.peers, key)
+}
+
+// release forgets every sender and every undelivered message
+func (r *receiverState) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopLocked()
+	r.ready = nil
+	r.readyBytes = 0
+}
+
+// stop forgets every sender and stops the ACK and sweep timers, keeping
+// the messages that are ready to be read
+func (r *receiverState) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+}
+
+// stopLocked is stop for callers that hold r.mu
+func (r *receiverState) stopLocked() {
+	for key, peer := range r.peers {
+		r.forgetLocked(key, peer)
+	}
+	r.stopped = true
+	r.peerTimeout = 0
+	if r.sweepTimer != nil {
+		r.sweepTimer.Stop()
+		r.sweepTimer = nil
+	}
+}
+
+// configure applies the receive buffer size and ACK policy of cfg
+func (r *receiverState) configure(cfg Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.capacity = cfg.ReceiveWindow
+	r.ackPolicy = cfg.AckPolicy
+	r.ackEvery = cfg.AckEvery
+	r.ackDelay = cfg.AckDelay
+}
+
+// window returns the free receive buffer space to advertise: the capacity
+// minus messages waiting to be read and packets held out of order.
+// Partially reassembled messages are bounded separately.
+func (r *receiverState) window() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.windowLocked()
+}
+
+// windowLocked is window for callers that hold r.mu
+func (r *receiverState) windowLocked() int {
+	free := r.capacity - r.readyBytes - r.bufferedBytes
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+// expect sets the next in-order sequence number from addr, for peers whose
+// initial sequence number is learned from a handshake
+func (r *receiverState) expect(addr *net.UDPAddr, seq int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.peers[addr.String()]; ok {
+		r.forgetLocked(addr.String(), old)
+	}
+	peer := newPeerState()
+	peer.next = seq
+	r.peers[addr.String()] = peer
+}
+
+// accept runs a data packet from addr through that sender's ordering state
+// and queues whatever became deliverable. It returns the sequence number to
+// acknowledge, or 0 if the packet must not be ACKed.
+func (r *receiverState) accept(addr *net.UDPAddr, h Header, payload []byte) (acceptResult, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.sweepLocked(now)
+
+	key := addr.String()
+	peer, ok := r.peers[key]
+	if ok && h.Flags&FlagResync != 0 && h.SequenceNumber < peer.next-MaxWindowSize {
+		// Too far behind to be a retransmission: the sender released its
+		// socket or restarted, so its old state is of no use
+		r.forgetLocked(key, peer)
+		ok = false
+	}
+	if !ok {
+		peer = newPeerState()
+		r.peers[key] = peer
+	}
+	peer.lastHeard = now
+
+	if h.Flags&FlagFEC != 0 {
+		peer.recordFEC(h, payload)
+	}
+	buffered := peer.bufferedBytes
+	ready, result, ack := peer.accept(h, payload)
+	r.bufferedBytes += peer.bufferedBytes - buffered
+
+	for _, seg := range ready {
+		if msg, ok := r.reassemble(peer, seg); ok {
+			compressed := seg.flags&FlagCompressed != 0
+			r.ready = append(r.ready, delivery{data: msg, addr: addr, compressed: compressed})
+			r.readyBytes += len(msg)
+		}
+	}
+	return result, ack
+}
+
+// requestResync asks the sender at addr to resend its oldest
+// unacknowledged packet with FlagResync, after accept found no state for it
+func (r *receiverState) requestResync(addr *net.UDPAddr, h Header) error {
+	return r.write(addr, encodeResync(h.SequenceNumber))
+}
+
+// ackForLocked returns what to report in the immediate ACK of a packet
+// from addr with header h: the receive window and, if the sender asked for
+// them, the peer's SACK ranges. Caller must hold r.mu.
+func (r *receiverState) ackForLocked(addr *net.UDPAddr, h Header) ackInfo {
+	info := ackInfo{window: r.windowLocked()}
+	if h.Flags&FlagSack == 0 {
+		return info
+	}
+	if peer, ok := r.peers[addr.String()]; ok {
+		info.sack = peer.sackRanges()
+	}
+	return info
+}
+
+// pop returns the oldest queued delivery, if any
+func (r *receiverState) pop() (delivery, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.ready) == 0 {
+		return delivery{}, false
+	}
+	d := r.ready[0]
+	r.ready[0] = delivery{}
+	r.ready = r.ready[1:]
+	r.readyBytes -= len(d.data)
+	return d, true
+}
@@ -0,0 +1,159 @@
+package reliable_udp
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff selects how the retransmission timeout grows between attempts
+type Backoff int
+
+const (
+	// BackoffExponential multiplies the timeout by Multiplier on every retry
+	BackoffExponential Backoff = iota
+	// BackoffLinear adds Multiplier times the base timeout on every retry
+	BackoffLinear
+	// BackoffConstant waits the base timeout before every retry
+	BackoffConstant
+)
+
+func (b Backoff) String() string {
+	switch b {
+	case BackoffExponential:
+		return "exponential"
+	case BackoffLinear:
+		return "linear"
+	case BackoffConstant:
+		return "constant"
+	default:
+		return fmt.Sprintf("Backoff(%d)", int(b))
+	}
+}
+
+// Jitter selects how much randomness is applied to each timeout
+type Jitter int
+
+const (
+	// JitterNone uses the computed timeout as is
+	JitterNone Jitter = iota
+	// JitterFull picks uniformly from (0, timeout]
+	JitterFull
+	// JitterEqual keeps half the timeout and randomizes the other half
+	JitterEqual
+)
+
+func (j Jitter) String() string {
+	switch j {
+	case JitterNone:
+		return "none"
+	case JitterFull:
+		return "full"
+	case JitterEqual:
+		return "equal"
+	default:
+		return fmt.Sprintf("Jitter(%d)", int(j))
+	}
+}
+
+// RetryPolicy decides how long to wait for an ACK before each retransmission
+// and when to give up. The zero value doubles the timeout on every retry and
+// gives up after MaxRetries transmissions, but not before MaxRetries times
+// RetryTimeout has passed.
+type RetryPolicy struct {
+	Backoff Backoff
+	// Multiplier is the growth factor for exponential backoff (default 2)
+	// or the step, in multiples of the base timeout, for linear backoff
+	// (default 1)
+	Multiplier float64
+	// MaxDelay caps a single timeout (default Config.MaxRTO)
+	MaxDelay time.Duration
+	Jitter   Jitter
+	// MaxAttempts is the number of transmissions, including the first,
+	// before giving up
+	MaxAttempts int
+	// MaxElapsed gives up once this long has passed since the first
+	// transmission. If neither budget is set, MaxAttempts is MaxRetries.
+	MaxElapsed time.Duration
+	// MinElapsed keeps retrying past MaxAttempts until this long has passed
+	// since the first transmission, so that a low RTO does not make the
+	// sender give up within milliseconds
+	MinElapsed time.Duration
+}
+
+// DefaultRetryPolicy returns the policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Backoff:     BackoffExponential,
+		Multiplier:  2,
+		MaxDelay:    DefaultMaxRTO,
+		MaxAttempts: MaxRetries,
+		MinElapsed:  MaxRetries * RetryTimeout,
+	}
+}
+
+// normalize fills in defaults, capping delays at maxDelay when unset
+func (p RetryPolicy) normalize(maxDelay time.Duration) RetryPolicy {
+	if p.Multiplier <= 0 {
+		if p.Backoff == BackoffLinear {
+			p.Multiplier = 1
+		} else {
+			p.Multiplier = 2
+		}
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = maxDelay
+	}
+	if p.MaxAttempts <= 0 && p.MaxElapsed <= 0 {
+		p.MaxAttempts = MaxRetries
+		if p.MinElapsed <= 0 {
+			p.MinElapsed = MaxRetries * RetryTimeout
+		}
+	}
+	return p
+}
+
+// Delay returns how long to wait for an ACK after the given attempt
+// (0 for the first transmission), starting from the base timeout
+func (p RetryPolicy) Delay(attempt int, base time.Duration) time.Duration {
+	var d float64
+	switch p.Backoff {
+	case BackoffLinear:
+		d = float64(base) * (1 + p.Multiplier*float64(attempt))
+	case BackoffConstant:
+		d = float64(base)
+	default:
+		d = float64(base) * math.Pow(p.Multiplier, float64(attempt))
+	}
+
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	delay := time.Duration(d)
+	if delay <= 0 {
+		return base
+	}
+
+	switch p.Jitter {
+	case JitterFull:
+		return time.Duration(rand.Int63n(int64(delay))) + 1
+	case JitterEqual:
+		half := delay / 2
+		return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+	default:
+		return delay
+	}
+}
+
+// Exhausted reports whether the budget is used up after the given number of
+// transmissions and the time elapsed since the first one
+func (p RetryPolicy) Exhausted(attempts int, elapsed time.Duration) bool {
+	if p.MaxElapsed > 0 && elapsed >= p.MaxElapsed {
+		return true
+	}
+	if elapsed < p.MinElapsed {
+		return false
+	}
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
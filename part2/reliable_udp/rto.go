@@ -0,0 +1,87 @@
+package reliable_udp
+
+import (
+	"sync"
+	"time"
+)
+
+// rttEstimator computes the retransmission timeout from ACK round trips
+// following RFC 6298: a smoothed RTT (SRTT), its mean deviation (RTTVAR),
+// and RTO = SRTT + 4*RTTVAR clamped to [minRTO, maxRTO].
+//
+// When the peer delays its ACKs, the delay it reports is taken out of each
+// sample, and the smoothed delay is added to the RTO so that a held-back ACK
+// is not mistaken for a loss.
+//
+// Per Karn's algorithm callers must only feed samples from packets that were
+// never retransmitted, since an ACK of a retransmission is ambiguous.
+type rttEstimator struct {
+	mu       sync.Mutex
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	ackDelay time.Duration // smoothed ACK delay the peer reported
+	minRTO   time.Duration
+	maxRTO   time.Duration
+	stats    *Statistics
+}
+
+// newRTTEstimator starts at RetryTimeout until the first sample arrives.
+// Estimates are reported to st.
+func newRTTEstimator(cfg Config, st *Statistics) *rttEstimator {
+	e := &rttEstimator{minRTO: cfg.MinRTO, maxRTO: cfg.MaxRTO, stats: st}
+	e.rto = e.clamp(RetryTimeout)
+	return e
+}
+
+// sample folds a new RTT measurement into the estimate. ackDelay is how
+// long the receiver reported holding the ACK back.
+func (e *rttEstimator) sample(rtt, ackDelay time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ackDelay < rtt {
+		rtt -= ackDelay
+	}
+
+	if e.srtt == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.ackDelay = ackDelay
+	} else {
+		e.ackDelay = (7*e.ackDelay + ackDelay) / 8
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.rto = e.clamp(e.srtt + 4*e.rttvar + e.ackDelay)
+
+	e.stats.onRTO(e.srtt, e.rto)
+}
+
+// RTO returns the current retransmission timeout
+func (e *rttEstimator) RTO() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rto
+}
+
+// SRTT returns the smoothed round-trip time, or 0 before the first sample
+func (e *rttEstimator) SRTT() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt
+}
+
+func (e *rttEstimator) clamp(d time.Duration) time.Duration {
+	if d < e.minRTO {
+		return e.minRTO
+	}
+	if d > e.maxRTO {
+		return e.maxRTO
+	}
+	return d
+}
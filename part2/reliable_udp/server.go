@@ -0,0 +1,341 @@
+package reliable_udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrServerClosed  = errors.New("server closed")
+	ErrSessionClosed = errors.New("session closed")
+)
+
+// Handler is called with every message a session receives, in order. Each
+// session calls its handler from its own goroutine.
+type Handler func(s *Session, msg []byte)
+
+// Server receives from many SendReliable / WindowSender peers on one
+// socket. Datagrams are demultiplexed by remote address into sessions, each
+// with its own sequence tracking, reorder buffer and statistics. Sessions
+// that hear nothing for Config.IdleTimeout are reaped.
+type Server struct {
+	sock    *net.UDPConn
+	io      *batchConn
+	cfg     Config
+	crypto  *packetCrypto
+	handler Handler
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	backlog  chan *Session
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Session is the receive state of one peer of a Server
+type Session struct {
+	server *Server
+	addr   *net.UDPAddr
+	recv   *receiverState
+	stats  *Statistics
+
+	lastHeard atomic.Int64 // UnixNano of the last packet from the peer
+
+	notify    chan struct{} // wakes Receive when messages are queued
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// NewServer starts receiving on address. If handler is nil, new sessions
+// are returned by Accept; otherwise handler is called with each message.
+func NewServer(address string, cfg Config, handler Handler) (*Server, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+	pc, err := newPacketCrypto(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	s := &Server{
+		sock:     sock,
+		cfg:      cfg.normalize(),
+		crypto:   pc,
+		handler:  handler,
+		sessions: make(map[string]*Session),
+		backlog:  make(chan *Session, ListenBacklog),
+		done:     make(chan struct{}),
+	}
+	s.io = newBatchConn(sock, s.cfg.BatchSize)
+	go s.readLoop()
+	go s.reap()
+	return s, nil
+}
+
+// Addr returns the server's network address
+func (s *Server) Addr() net.Addr {
+	return s.sock.LocalAddr()
+}
+
+// Accept waits for the first message from a new peer and returns its
+// session. It is only used when the server has no handler.
+func (s *Server) Accept() (*Session, error) {
+	select {
+	case sess := <-s.backlog:
+		return sess, nil
+	case <-s.done:
+		return nil, ErrServerClosed
+	}
+}
+
+// Sessions returns the currently active sessions
+func (s *Server) Sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// Close stops the server, closes every session and the socket
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.io.close()
+		err = s.sock.Close()
+
+		for _, sess := range s.Sessions() {
+			sess.close(ErrServerClosed)
+		}
+	})
+	return err
+}
+
+// readLoop runs every datagram through its sender's session and ACKs it
+func (s *Server) readLoop() {
+	for {
+		ms, err := s.io.read()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		for _, m := range ms {
+			s.handleDatagram(m.Buffers[0][:m.N], m.Addr.(*net.UDPAddr))
+		}
+	}
+}
+
+// handleDatagram runs a datagram from addr through its session
+func (s *Server) handleDatagram(buf []byte, addr *net.UDPAddr) {
+	header, payload, err := decodeReceived(buf, s.cfg.Checksum, s.statsFor(addr), s.crypto)
+	if err == nil && header.Type == PacketProbe {
+		s.writeTo(addr, encodeProbeAck(header))
+		return
+	}
+	if err != nil || header.Type != PacketData && header.Type != PacketParity {
+		return
+	}
+
+	sess := s.session(addr)
+	if sess == nil {
+		// Too many sessions or the Accept backlog is full; the sender will
+		// retransmit
+		return
+	}
+	addr = sess.addr
+	sess.lastHeard.Store(time.Now().UnixNano())
+
+	if artificialDrop(sess.stats) {
+		return
+	}
+	if header.Type == PacketParity {
+		sess.recv.addParity(addr, header, payload)
+		if sess.recv.recoverLost(addr) > 0 {
+			sess.signal()
+		}
+		return
+	}
+	result, ack := sess.recv.accept(addr, header, payload)
+	if result == acceptUnsynced {
+		// The peer's previous session was reaped or closed
+		sess.recv.requestResync(addr, header)
+		return
+	}
+	if ack == 0 {
+		return
+	}
+	sess.recv.acknowledge(addr, header, ack, result)
+	if header.Flags&FlagFEC != 0 {
+		sess.recv.recoverLost(addr)
+	}
+
+	if result == acceptDuplicate {
+		sess.stats.onDuplicate()
+	}
+	sess.signal()
+}
+
+// session returns addr's session, creating it for a new peer. It returns
+// nil if the peer is new and the server has MaxSessions sessions or Accept
+// has too many waiting.
+func (s *Server) session(addr *net.UDPAddr) *Session {
+	key := addr.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[key]; ok {
+		return sess
+	}
+	if len(s.sessions) >= s.cfg.MaxSessions {
+		return nil
+	}
+
+	st := newStatistics()
+	sess := &Session{
+		server: s,
+		addr:   copyAddr(addr),
+		recv:   newReceiverState(s.cfg, st, s.writeTo),
+		stats:  st,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	sess.lastHeard.Store(time.Now().UnixNano())
+
+	if s.handler != nil {
+		go sess.serve(s.handler)
+	} else {
+		select {
+		case s.backlog <- sess:
+		default:
+			return nil
+		}
+	}
+	s.sessions[key] = sess
+	return sess
+}
+
+// writeTo seals an ACK datagram and sends it to addr
+func (s *Server) writeTo(addr *net.UDPAddr, b []byte) error {
+	return s.io.write(s.crypto.seal(b, s.cfg.Checksum), addr)
+}
+
+// statsFor returns the statistics of addr's session, or the aggregate if
+// the peer has none yet
+func (s *Server) statsFor(addr *net.UDPAddr) *Statistics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[addr.String()]; ok {
+		return sess.stats
+	}
+	return &stats
+}
+
+// reap closes sessions that have been idle for longer than IdleTimeout
+func (s *Server) reap() {
+	if s.cfg.IdleTimeout < 0 {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.IdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			for _, sess := range s.Sessions() {
+				if now.Sub(time.Unix(0, sess.lastHeard.Load())) > s.cfg.IdleTimeout {
+					sess.close(ErrIdleTimeout)
+				}
+			}
+		}
+	}
+}
+
+// RemoteAddr returns the peer's network address
+func (sess *Session) RemoteAddr() net.Addr {
+	return sess.addr
+}
+
+// Statistics returns the counters of this session
+func (sess *Session) Statistics() StatisticsCopy {
+	return sess.stats.snapshot()
+}
+
+// Receive blocks until the peer's next message is available. Once the
+// session is closed and its queued messages are read it returns the reason,
+// such as ErrIdleTimeout.
+func (sess *Session) Receive() ([]byte, error) {
+	for {
+		if d, ok := sess.recv.pop(); ok {
+			return d.data, nil
+		}
+		select {
+		case <-sess.notify:
+		case <-sess.done:
+			if d, ok := sess.recv.pop(); ok {
+				return d.data, nil
+			}
+			return nil, sess.err
+		}
+	}
+}
+
+// Close forgets the session. Later packets from the peer start a new one.
+func (sess *Session) Close() error {
+	sess.close(ErrSessionClosed)
+	return nil
+}
+
+func (sess *Session) close(err error) {
+	sess.closeOnce.Do(func() {
+		s := sess.server
+		s.mu.Lock()
+		if s.sessions[sess.addr.String()] == sess {
+			delete(s.sessions, sess.addr.String())
+		}
+		s.mu.Unlock()
+
+		sess.recv.stop()
+		sess.err = err
+		close(sess.done)
+	})
+}
+
+// signal wakes a blocked Receive
+func (sess *Session) signal() {
+	select {
+	case sess.notify <- struct{}{}:
+	default:
+	}
+}
+
+// serve hands each message to the handler until the session is closed
+func (sess *Session) serve(handler Handler) {
+	for {
+		msg, err := sess.Receive()
+		if err != nil {
+			return
+		}
+		handler(sess, msg)
+	}
+}
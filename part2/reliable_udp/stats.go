@@ -0,0 +1,308 @@
+package reliable_udp
+
+import (
+	"net"
+	"time"
+)
+
+func newStatistics() *Statistics {
+	return &Statistics{retransmissions: make(map[Mode]int)}
+}
+
+// add applies fn to s and to the package-level aggregate
+func (s *Statistics) add(fn func(*Statistics)) {
+	if s != &stats {
+		s.mu.Lock()
+		fn(s)
+		s.mu.Unlock()
+	}
+	stats.mu.Lock()
+	fn(&stats)
+	stats.mu.Unlock()
+}
+
+// onSent records the first transmission of a data packet
+func (s *Statistics) onSent(payload int) {
+	now := time.Now()
+	s.add(func(s *Statistics) {
+		s.sentPackets++
+		s.bytesSent += int64(payload)
+		if s.firstSent.IsZero() {
+			s.firstSent = now
+		}
+	})
+}
+
+// onRetransmit records a retransmission in the given mode, triggered by a
+// NACK if fast is set and by a timeout otherwise
+func (s *Statistics) onRetransmit(mode Mode, payload int, fast bool) {
+	s.add(func(s *Statistics) {
+		s.droppedPackets++
+		s.retransmissions[mode]++
+		s.bytesSent += int64(payload)
+		if fast {
+			s.fastRetransmits++
+		}
+	})
+}
+
+// onAcked records an acknowledged data packet and its round-trip time
+func (s *Statistics) onAcked(payload int, rtt time.Duration) {
+	now := time.Now()
+	s.add(func(s *Statistics) {
+		s.recvPackets++
+		s.bytesAcked += int64(payload)
+		s.lastAcked = now
+
+		s.rttSamples++
+		s.totalRTT += rtt
+		if s.minRTT == 0 || rtt < s.minRTT {
+			s.minRTT = rtt
+		}
+		if rtt > s.maxRTT {
+			s.maxRTT = rtt
+		}
+	})
+}
+
+// onLost records a packet whose retry budget ran out
+func (s *Statistics) onLost() {
+	s.add(func(s *Statistics) { s.lostPackets++ })
+}
+
+// onDuplicate records a data packet that was received before
+func (s *Statistics) onDuplicate() {
+	s.add(func(s *Statistics) { s.duplicatePackets++ })
+}
+
+// onWindowStall records time a sender spent blocked by the peer's receive
+// window
+func (s *Statistics) onWindowStall(d time.Duration) {
+	s.add(func(s *Statistics) { s.windowStalled += d })
+}
+
+// onZeroWindowProbe records a packet sent to probe a zero receive window
+func (s *Statistics) onZeroWindowProbe() {
+	s.add(func(s *Statistics) { s.zeroWindowProbes++ })
+}
+
+// onSackAvoided records retransmissions Go-Back-N skipped thanks to SACK
+func (s *Statistics) onSackAvoided(n int) {
+	s.add(func(s *Statistics) { s.sackAvoided += n })
+}
+
+// onCompressed records a message compressed from in to out bytes
+func (s *Statistics) onCompressed(in, out int, d time.Duration) {
+	s.add(func(s *Statistics) {
+		s.compressedMsgs++
+		s.compressionIn += int64(in)
+		s.compressionOut += int64(out)
+		s.compressTime += d
+	})
+}
+
+// onCompressionSkipped records a message sent raw after spending d on
+// trying to compress it
+func (s *Statistics) onCompressionSkipped(d time.Duration) {
+	s.add(func(s *Statistics) {
+		s.compressionSkipped++
+		s.compressTime += d
+	})
+}
+
+// onDecompressed records time spent decompressing a message
+func (s *Statistics) onDecompressed(d time.Duration) {
+	s.add(func(s *Statistics) { s.decompressTime += d })
+}
+
+// onParitySent records a parity packet with payload bytes
+func (s *Statistics) onParitySent(payload int) {
+	s.add(func(s *Statistics) {
+		s.parityPackets++
+		s.parityBytes += int64(payload)
+	})
+}
+
+// onFECRecovered records a lost data packet rebuilt from parity
+func (s *Statistics) onFECRecovered() {
+	s.add(func(s *Statistics) { s.fecRecovered++ })
+}
+
+// onPathMTU records the path MTU confirmed last and the packet size it
+// allows
+func (s *Statistics) onPathMTU(mtu, packetSize int) {
+	s.add(func(s *Statistics) {
+		s.pathMTU = mtu
+		s.packetSize = packetSize
+	})
+}
+
+// onMTUProbe records a path MTU probe
+func (s *Statistics) onMTUProbe() {
+	s.add(func(s *Statistics) { s.mtuProbes++ })
+}
+
+// onMTUBlackHole records a confirmed path MTU that stopped getting through
+func (s *Statistics) onMTUBlackHole() {
+	s.add(func(s *Statistics) { s.mtuBlackHoles++ })
+}
+
+// onRTO records the latest RTT estimate
+func (s *Statistics) onRTO(srtt, rto time.Duration) {
+	s.add(func(s *Statistics) {
+		s.srtt = srtt
+		s.rto = rto
+	})
+}
+
+// snapshot copies the counters out
+func (s *Statistics) snapshot() StatisticsCopy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	retransmissions := make(map[Mode]int, len(s.retransmissions))
+	retransmits := 0
+	for mode, n := range s.retransmissions {
+		retransmissions[mode] = n
+		retransmits += n
+	}
+
+	var avgRTT time.Duration
+	if s.rttSamples > 0 {
+		avgRTT = s.totalRTT / time.Duration(s.rttSamples)
+	}
+	var compressionRatio float64
+	if s.compressionOut > 0 {
+		compressionRatio = float64(s.compressionIn) / float64(s.compressionOut)
+	}
+	var fecOverhead float64
+	if s.bytesSent > 0 {
+		fecOverhead = float64(s.parityBytes) / float64(s.bytesSent)
+	}
+	var goodput float64
+	if elapsed := s.lastAcked.Sub(s.firstSent); elapsed > 0 {
+		goodput = float64(s.bytesAcked) / elapsed.Seconds()
+	}
+
+	return StatisticsCopy{
+		SentPackets:        s.sentPackets,
+		RecvPackets:        s.recvPackets,
+		LostPackets:        s.lostPackets,
+		DroppedPackets:     s.droppedPackets,
+		DuplicatePackets:   s.duplicatePackets,
+		Retransmits:        retransmits,
+		FastRetransmits:    s.fastRetransmits,
+		TimeoutRetransmits: retransmits - s.fastRetransmits,
+		Retransmissions:    retransmissions,
+		ReassemblyFailures: s.reassemblyFailures,
+		BytesSent:          s.bytesSent,
+		BytesAcked:         s.bytesAcked,
+		Goodput:            goodput,
+		TotalRTT:           s.totalRTT,
+		MinRTT:             s.minRTT,
+		AvgRTT:             avgRTT,
+		MaxRTT:             s.maxRTT,
+		SRTT:               s.srtt,
+		RTO:                s.rto,
+		WindowStalled:      s.windowStalled,
+		ZeroWindowProbes:   s.zeroWindowProbes,
+		CorruptPackets:     s.corruptPackets,
+		AcksSent:           s.acksSent,
+		SackAvoided:        s.sackAvoided,
+		AuthFailures:       s.authFailures,
+		ReplayedPackets:    s.replayedPackets,
+		KeyUpdates:         s.keyUpdates,
+		CompressedMessages: s.compressedMsgs,
+		CompressionSkipped: s.compressionSkipped,
+		CompressionRatio:   compressionRatio,
+		CompressTime:       s.compressTime,
+		DecompressTime:     s.decompressTime,
+		ParityPackets:      s.parityPackets,
+		ParityBytes:        s.parityBytes,
+		FECOverhead:        fecOverhead,
+		FECRecovered:       s.fecRecovered,
+		PathMTU:            s.pathMTU,
+		PacketSize:         s.packetSize,
+		MTUProbes:          s.mtuProbes,
+		MTUBlackHoles:      s.mtuBlackHoles,
+		DropRate:           dropRate(s),
+	}
+}
+
+// dropRate returns the configured artificial drop rate. s.mu is held by
+// the caller, and it may be the aggregate's own lock.
+func dropRate(s *Statistics) float64 {
+	if s == &stats {
+		return s.dropRate
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return stats.dropRate
+}
+
+// reset zeroes all counters except the drop and corruption rates. Caller must hold s.mu.
+func (s *Statistics) reset() {
+	s.sentPackets = 0
+	s.recvPackets = 0
+	s.lostPackets = 0
+	s.droppedPackets = 0
+	s.duplicatePackets = 0
+	s.retransmissions = make(map[Mode]int)
+	s.fastRetransmits = 0
+	s.reassemblyFailures = 0
+	s.bytesSent = 0
+	s.bytesAcked = 0
+	s.rttSamples = 0
+	s.totalRTT = 0
+	s.minRTT = 0
+	s.maxRTT = 0
+	s.srtt = 0
+	s.rto = 0
+	s.firstSent = time.Time{}
+	s.lastAcked = time.Time{}
+	s.windowStalled = 0
+	s.zeroWindowProbes = 0
+	s.corruptPackets = 0
+	s.acksSent = 0
+	s.sackAvoided = 0
+	s.authFailures = 0
+	s.replayedPackets = 0
+	s.keyUpdates = 0
+	s.compressedMsgs = 0
+	s.compressionSkipped = 0
+	s.compressionIn = 0
+	s.compressionOut = 0
+	s.compressTime = 0
+	s.decompressTime = 0
+	s.parityPackets = 0
+	s.parityBytes = 0
+	s.fecRecovered = 0
+	s.pathMTU = 0
+	s.packetSize = 0
+	s.mtuProbes = 0
+	s.mtuBlackHoles = 0
+}
+
+// GetConnStatistics returns the statistics of conn, covering SendReliable,
+// SendAsync, WindowSender and ReceiveReliable on that socket. A socket that
+// was never used or has been released reports zero statistics.
+func GetConnStatistics(conn *net.UDPConn) StatisticsCopy {
+	ep, ok := endpoints.Load(conn)
+	if !ok {
+		return newStatistics().snapshot()
+	}
+	return ep.(*endpoint).stats.snapshot()
+}
+
+// ResetConnStatistics resets the statistics of conn. The aggregate is not
+// affected.
+func ResetConnStatistics(conn *net.UDPConn) {
+	ep, ok := endpoints.Load(conn)
+	if !ok {
+		return
+	}
+	st := ep.(*endpoint).stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reset()
+}
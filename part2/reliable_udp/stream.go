@@ -0,0 +1,226 @@
+package reliable_udp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// StreamConn is a reliable, ordered byte stream over a Conn. It implements
+// net.Conn, so it can carry bufio, io.Copy, encoding/gob or HTTP traffic.
+//
+// Writes are cut into segments of one packet each, MaxPacketSize bytes or
+// what path MTU discovery found, that are sent through the connection's
+// window; reads return the segments' bytes in order without preserving
+// write boundaries.
+type StreamConn struct {
+	c *Conn
+
+	readMu  sync.Mutex
+	pending []byte // unread rest of the last received segment
+
+	writeMu sync.Mutex
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+var _ net.Conn = (*StreamConn)(nil)
+
+// NewStreamConn wraps an established connection as a byte stream. The
+// connection must not be used for messages while the stream is in use.
+func NewStreamConn(c *Conn) *StreamConn {
+	return &StreamConn{
+		c:             c,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+}
+
+// DialStream connects to a StreamListener at address
+func DialStream(address string, cfg Config) (*StreamConn, error) {
+	c, err := Dial(address, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(c), nil
+}
+
+// Conn returns the underlying message connection
+func (s *StreamConn) Conn() *Conn {
+	return s.c
+}
+
+// Read reads up to len(b) bytes from the stream. It returns io.EOF once the
+// peer has closed and all its data was read.
+func (s *StreamConn) Read(b []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(s.pending) == 0 {
+		data, err := s.c.receive(s.readDeadline.wait())
+		if err != nil {
+			return 0, streamError(err)
+		}
+		s.pending = data
+	}
+
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Write sends b as one or more segments. It blocks while the send window is
+// full and returns once every segment is on the wire. On a deadline or
+// connection error it returns the number of bytes already sent.
+func (s *StreamConn) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	n := 0
+	for n < len(b) {
+		end := n + s.c.window.packetSize()
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := s.c.send(b[n:end], s.c.cfg.RetryPolicy, s.writeDeadline.wait()); err != nil {
+			return n, streamError(err)
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// Close flushes written data and closes the connection, see Conn.Close
+func (s *StreamConn) Close() error {
+	return s.c.Close()
+}
+
+// LocalAddr returns the local network address
+func (s *StreamConn) LocalAddr() net.Addr {
+	return s.c.LocalAddr()
+}
+
+// RemoteAddr returns the peer's network address
+func (s *StreamConn) RemoteAddr() net.Addr {
+	return s.c.RemoteAddr()
+}
+
+// SetDeadline sets both the read and the write deadline
+func (s *StreamConn) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline makes pending and future Reads fail with
+// os.ErrDeadlineExceeded after t. A zero t disables the deadline.
+func (s *StreamConn) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline makes Writes that are blocked on a full send window fail
+// with os.ErrDeadlineExceeded after t. A zero t disables the deadline.
+func (s *StreamConn) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// streamError maps internal cancellation errors to the net.Conn deadline error
+func streamError(err error) error {
+	if errors.Is(err, errSendCanceled) || errors.Is(err, errReceiveCanceled) {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// StreamListener accepts StreamConns. It implements net.Listener.
+type StreamListener struct {
+	l *Listener
+}
+
+var _ net.Listener = (*StreamListener)(nil)
+
+// ListenStream starts accepting stream connections on address
+func ListenStream(address string, cfg Config) (*StreamListener, error) {
+	l, err := Listen(address, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamListener{l: l}, nil
+}
+
+// Accept waits for the next connection
+func (sl *StreamListener) Accept() (net.Conn, error) {
+	c, err := sl.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(c), nil
+}
+
+// Close stops the listener and closes its connections
+func (sl *StreamListener) Close() error {
+	return sl.l.Close()
+}
+
+// Addr returns the listener's network address
+func (sl *StreamListener) Addr() net.Addr {
+	return sl.l.Addr()
+}
+
+// deadline is a resettable timer that closes a channel when it expires
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed once the deadline has passed
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set arms the deadline for t; a zero t disarms it
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired; wait for it to close the channel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	expired := isDone(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline expires
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
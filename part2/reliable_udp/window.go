@@ -0,0 +1,1084 @@
+package reliable_udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSenderClosed = errors.New("window sender closed")
+	errFlushTimeout = errors.New("flush timed out")
+	errSendCanceled = errors.New("send canceled")
+)
+
+// inflightPacket is a sent but not yet acknowledged packet
+type inflightPacket struct {
+	wire    []byte
+	policy  RetryPolicy
+	sentAt  time.Time
+	retries int  // retransmissions charged to this packet's retry budget
+	resent  bool // retransmitted at least once, so its ACK is no RTT sample
+	fast    bool // fast retransmitted since its last timeout
+	resync  bool // FlagResync was added because the receiver lost its state
+	timer   *time.Timer
+	msg     *windowMessage // nil unless the sender waits for the message
+
+	delivered   int64     // sender's delivered bytes when this was sent
+	deliveredAt time.Time // and when they were last updated
+}
+
+// windowMessage tracks the packets of one message for a sender that waits
+// for the message as a whole, such as SendAsync
+type windowMessage struct {
+	done func(rtt time.Duration, err error) // called once, without w.mu held
+
+	seqs     []int64   // packets sent so far
+	pending  int       // packets sent but not acknowledged
+	sent     bool      // every packet is on the wire
+	sentAt   time.Time // first transmission
+	finished bool
+	rtt      time.Duration
+	err      error
+}
+
+// sendWindow is the windowed transmission engine behind WindowSender and
+// Conn. It keeps up to WindowSize packets in flight. In ModeSelectiveRepeat
+// every packet has its own retransmit timer, and only packets whose ACK does
+// not arrive in time are sent again. In ModeGoBackN a single timer guards
+// the oldest unacknowledged packet and everything from it onwards is resent
+// when it fires. With Config.SACK, packets the receiver reports in SACK
+// ranges are retired early and skipped by that retransmission.
+//
+// A CongestionController, if configured, can shrink the window below
+// WindowSize and pace transmissions. Independently, the payload bytes in
+// flight never exceed the receive window the peer advertises in its ACKs.
+// While that window is zero, a single packet is let through as a probe
+// after a backed-off delay, so that its ACK reports when space frees up.
+//
+// The owner delivers ACKs through handleAck.
+type sendWindow struct {
+	cfg     Config
+	stats   *Statistics
+	rtt     *rttEstimator
+	cc      CongestionController
+	write   func([]byte) error
+	nextSeq func() int64
+
+	sendMu sync.Mutex // serializes sends
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inflight map[int64]*inflightPacket
+	blocked  int            // senders waiting for room in the window
+	timer    *time.Timer    // Go-Back-N retransmit timer
+	sacked   map[int64]bool // retired by SACK, above the cumulative ACK
+	started  bool
+	closed   bool
+	closeErr error
+	err      error
+
+	created     time.Time
+	nextSend    time.Time // earliest time pacing allows the next packet
+	delivered   int64     // wire bytes acknowledged so far
+	deliveredAt time.Time
+	trace       []CwndSample
+	lastCwnd    int
+
+	peerWindow    int // free receive buffer the peer last advertised
+	inflightBytes int // payload bytes sent but not acknowledged
+	probes        int // zero-window probes sent since the window closed
+	probeAt       time.Time
+	probeTimer    *time.Timer
+
+	fec  fecGroup  // parity of the packets sent since the last parity packet
+	pmtu pmtuState // path MTU search, if enabled
+
+	gap      int64            // highest packet abandoned with its message, 0 if none is pending
+	finished []*windowMessage // messages to complete once w.mu is released
+}
+
+// newSendWindow creates an engine that transmits with write, numbers
+// packets with nextSeq and counts into st. If resync is set, the first
+// packet carries FlagResync so that a receiver without prior state can
+// start from it.
+func newSendWindow(cfg Config, st *Statistics, write func([]byte) error, nextSeq func() int64, resync bool) *sendWindow {
+	cfg = cfg.normalize()
+	w := &sendWindow{
+		cfg:      cfg,
+		stats:    st,
+		rtt:      newRTTEstimator(cfg, st),
+		cc:       newCongestionController(cfg),
+		write:    write,
+		nextSeq:  nextSeq,
+		inflight: make(map[int64]*inflightPacket),
+		sacked:   make(map[int64]bool),
+		started:  !resync,
+		created:  time.Now(),
+
+		peerWindow: cfg.ReceiveWindow,
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// unlock releases w.mu and then completes the messages that finished while
+// it was held
+func (w *sendWindow) unlock() {
+	finished := w.finished
+	w.finished = nil
+	w.mu.Unlock()
+
+	for _, m := range finished {
+		m.done(m.rtt, m.err)
+	}
+}
+
+// finishLocked ends m with err, or successfully if err is nil, and queues
+// its completion for unlock. Caller must hold w.mu.
+func (w *sendWindow) finishLocked(m *windowMessage, err error) {
+	if m.finished {
+		return
+	}
+	m.finished = true
+	m.err = err
+	if err == nil {
+		m.rtt = time.Since(m.sentAt)
+	}
+	w.finished = append(w.finished, m)
+}
+
+// limit is the number of packets that may be in flight. Caller must hold w.mu.
+func (w *sendWindow) limit() int {
+	n := w.cfg.WindowSize
+	if w.cc != nil {
+		if c := w.cc.Window(); c < n {
+			n = c
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// windowBlocked reports whether the peer's receive window has no room for
+// size more payload bytes. With nothing in flight one packet may always go,
+// except that a zero window only admits a probe once probeAt has passed.
+// Caller must hold w.mu.
+func (w *sendWindow) windowBlocked(size int) bool {
+	if len(w.inflight) > 0 {
+		return w.inflightBytes+size > w.peerWindow
+	}
+	if w.peerWindow > 0 {
+		return false
+	}
+	if w.probeAt.IsZero() {
+		w.probeAt = time.Now().Add(probeDelay(w.rtt.RTO(), w.probes, w.cfg.MaxRTO))
+	}
+	d := time.Until(w.probeAt)
+	if d <= 0 {
+		return false
+	}
+	if w.probeTimer == nil {
+		w.probeTimer = time.AfterFunc(d, func() {
+			w.mu.Lock()
+			w.cond.Broadcast()
+			w.mu.Unlock()
+		})
+	} else {
+		w.probeTimer.Reset(d)
+	}
+	return true
+}
+
+// pacingDelay is how long pacing holds back the next packet.
+// Caller must hold w.mu.
+func (w *sendWindow) pacingDelay() time.Duration {
+	if w.cc == nil || w.cc.PacingRate() <= 0 {
+		return 0
+	}
+	return time.Until(w.nextSend)
+}
+
+// paced schedules the packet after one of size bytes. Caller must hold w.mu.
+func (w *sendWindow) paced(size int) {
+	if w.cc == nil {
+		return
+	}
+	rate := w.cc.PacingRate()
+	if rate <= 0 {
+		return
+	}
+	now := time.Now()
+	if w.nextSend.Before(now) {
+		w.nextSend = now
+	}
+	w.nextSend = w.nextSend.Add(time.Duration(float64(size) / rate * float64(time.Second)))
+}
+
+// traceCwnd records the congestion window if it changed or on loss.
+// Caller must hold w.mu.
+func (w *sendWindow) traceCwnd(loss bool) {
+	if w.cc == nil || !w.cfg.TraceCwnd {
+		return
+	}
+	cwnd := w.cc.Window()
+	if cwnd == w.lastCwnd && !loss {
+		return
+	}
+	w.lastCwnd = cwnd
+	w.trace = append(w.trace, CwndSample{
+		Time:       time.Since(w.created),
+		Cwnd:       cwnd,
+		PacingRate: w.cc.PacingRate(),
+		Inflight:   len(w.inflight),
+		Loss:       loss,
+	})
+}
+
+// cwndTrace returns a copy of the recorded congestion window trace
+func (w *sendWindow) cwndTrace() []CwndSample {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]CwndSample(nil), w.trace...)
+}
+
+// onLoss reports an expired retransmit timer to the congestion
+// controller. Caller must hold w.mu.
+func (w *sendWindow) onLoss(p *inflightPacket) {
+	if w.cc == nil {
+		return
+	}
+	w.cc.OnLoss(LossEvent{Now: time.Now(), SentAt: p.sentAt, Inflight: len(w.inflight)})
+	w.traceCwnd(true)
+}
+
+// send transmits a message, fragmenting it if needed, and blocks while the
+// window is full. Every packet carries flags, and is retransmitted
+// according to policy.
+//
+// If cancel is closed while waiting for room for the first packet, send
+// gives up with errSendCanceled. Once the first packet is on the wire the
+// rest of the message is always sent, so the receiver never sees half of it.
+func (w *sendWindow) send(data []byte, flags uint16, policy RetryPolicy, cancel <-chan struct{}) error {
+	return w.sendMessage(data, flags, policy, cancel, nil)
+}
+
+// sendMessage is send for a message tracked by m, if not nil: m.done is
+// called once every packet of the message is acknowledged, or with the error
+// that ended it. A message abandoned while it is being sent is cut short.
+func (w *sendWindow) sendMessage(data []byte, flags uint16, policy RetryPolicy, cancel <-chan struct{}, m *windowMessage) error {
+	if !validateMessage(data) {
+		err := fmt.Errorf("message size exceeds maximum allowed size of %d bytes", MaxMessageSize)
+		if m != nil {
+			w.mu.Lock()
+			w.finishLocked(m, err)
+			w.unlock()
+		}
+		return err
+	}
+
+	// Fragments of one message must occupy consecutive sequence numbers
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+
+	if cancel != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-cancel:
+				w.mu.Lock()
+				w.cond.Broadcast()
+				w.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	w.mu.Lock()
+	defer w.unlock()
+
+	policy = policy.normalize(w.cfg.MaxRTO)
+	payloads, fragmented := fragmentMessage(data, w.packetSizeLocked())
+	if fragmented {
+		flags |= FlagFragment
+	}
+	for i, payload := range payloads {
+		if i > 0 {
+			cancel = nil
+		}
+		if m != nil && m.finished {
+			return m.err
+		}
+		if err := w.sendPacket(payload, flags, policy, cancel, m); err != nil {
+			if m != nil {
+				w.finishLocked(m, err)
+			}
+			return err
+		}
+	}
+	if m != nil {
+		m.sent = true
+		if m.pending == 0 {
+			w.finishLocked(m, nil)
+		}
+	}
+	return nil
+}
+
+// sendPacket waits for room in the window and transmits one packet.
+// Caller must hold w.mu.
+func (w *sendWindow) sendPacket(payload []byte, flags uint16, policy RetryPolicy, cancel <-chan struct{}, m *windowMessage) error {
+	for {
+		for w.err == nil && !w.closed && !isDone(cancel) {
+			if len(w.inflight) >= w.limit() {
+				w.blocked++
+				w.cond.Wait()
+				w.blocked--
+				continue
+			}
+			if !w.windowBlocked(len(payload)) {
+				break
+			}
+			stalled := time.Now()
+			w.cond.Wait()
+			w.stats.onWindowStall(time.Since(stalled))
+		}
+		if w.err != nil {
+			return w.err
+		}
+		if w.closed {
+			return w.closeErr
+		}
+		if isDone(cancel) {
+			return errSendCanceled
+		}
+
+		d := w.pacingDelay()
+		if d <= 0 {
+			break
+		}
+		w.mu.Unlock()
+		time.Sleep(d)
+		w.mu.Lock()
+	}
+
+	packet := Packet{
+		SequenceNumber: w.nextSeq(),
+		Data:           payload,
+		Timestamp:      time.Now(),
+	}
+	packet.Flags |= flags
+	if w.cfg.Mode == ModeGoBackN {
+		packet.Flags |= FlagGoBackN
+		if w.cfg.SACK {
+			packet.Flags |= FlagSack
+		}
+	}
+	if w.cfg.FECGroup > 0 {
+		packet.Flags |= FlagFEC
+	}
+	if w.cfg.FastRetransmit {
+		packet.Flags |= FlagNack
+	}
+	if !w.started {
+		// Nothing from this sender is outstanding below its first packet
+		packet.Flags |= FlagResync
+		w.started = true
+	}
+
+	p := &inflightPacket{
+		wire:        packet.encode(PacketData),
+		policy:      policy,
+		sentAt:      packet.Timestamp,
+		msg:         m,
+		delivered:   w.delivered,
+		deliveredAt: w.deliveredAt,
+	}
+	if p.deliveredAt.IsZero() {
+		p.deliveredAt = p.sentAt
+	}
+	if err := w.write(p.wire); err != nil {
+		if isMessageTooLong(err) && w.pmtu.enabled {
+			w.pmtuRefusedLocked(w.pmtu.datagramSize(p.wire))
+		}
+		return fmt.Errorf("send error: %v", err)
+	}
+	w.paced(len(p.wire))
+	if w.cfg.FECGroup > 0 {
+		w.fecAdd(packet.SequenceNumber, packet.Flags, payload)
+	}
+
+	if w.peerWindow == 0 {
+		w.probes++
+		w.probeAt = time.Time{}
+		w.stats.onZeroWindowProbe()
+	}
+
+	seq := packet.SequenceNumber
+	w.inflight[seq] = p
+	w.inflightBytes += len(payload)
+	if m != nil {
+		if m.sentAt.IsZero() {
+			m.sentAt = p.sentAt
+		}
+		m.seqs = append(m.seqs, seq)
+		m.pending++
+	}
+	if w.cfg.Mode == ModeGoBackN {
+		if len(w.inflight) == 1 {
+			w.startTimer()
+		}
+	} else {
+		p.timer = time.AfterFunc(p.policy.Delay(0, w.rtt.RTO()), func() { w.retransmit(seq) })
+	}
+
+	w.stats.onSent(len(payload))
+
+	return nil
+}
+
+// flush blocks until every sent packet is acknowledged or the sender fails
+func (w *sendWindow) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.inflight) > 0 && w.err == nil && !w.closed {
+		w.cond.Wait()
+	}
+	return w.result()
+}
+
+// flushTimeout is like flush but gives up after d, returning
+// errFlushTimeout if packets are still unacknowledged
+func (w *sendWindow) flushTimeout(d time.Duration) error {
+	deadline := time.Now().Add(d)
+	wake := time.AfterFunc(d, func() {
+		w.mu.Lock()
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	})
+	defer wake.Stop()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.inflight) > 0 && w.err == nil && !w.closed {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: %d packets unacknowledged", errFlushTimeout, len(w.inflight))
+		}
+		w.cond.Wait()
+	}
+	return w.result()
+}
+
+// result is the outcome of a flush. Caller must hold w.mu.
+func (w *sendWindow) result() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.inflight) > 0 {
+		return w.closeErr
+	}
+	return nil
+}
+
+// stop disarms all timers and makes further sends fail with err
+func (w *sendWindow) stop(err error) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	w.closed = true
+	w.closeErr = err
+	w.stopTimers()
+	w.finishAllLocked(err)
+	w.cond.Broadcast()
+}
+
+// finishAllLocked ends every message with packets in flight with err.
+// Caller must hold w.mu.
+func (w *sendWindow) finishAllLocked(err error) {
+	for _, p := range w.inflight {
+		if p.msg != nil {
+			w.finishLocked(p.msg, err)
+		}
+	}
+}
+
+// failed reports whether a fatal error stopped the window
+func (w *sendWindow) failed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err != nil
+}
+
+// isDone reports whether ch is closed. A nil channel is never done.
+func isDone(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// retransmit resends seq when its timer fires, or fails the sender once
+// its retry budget is used up
+func (w *sendWindow) retransmit(seq int64) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	p, ok := w.inflight[seq]
+	if !ok || w.err != nil || w.closed {
+		return
+	}
+	w.onLoss(p)
+	p.fast = false
+	if !w.resend(seq, p, true, false) {
+		return
+	}
+	p.timer.Reset(p.policy.Delay(p.retries, w.rtt.RTO()))
+}
+
+// goBackN resends every outstanding packet, oldest first, when the
+// Go-Back-N timer fires. Only the oldest packet, whose ACK the timer was
+// waiting for, is charged a retry.
+func (w *sendWindow) goBackN() {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if len(w.inflight) == 0 || w.err != nil || w.closed {
+		return
+	}
+	outstanding := w.outstanding()
+	w.onLoss(w.inflight[outstanding[0]])
+	if avoided := w.sackedAbove(outstanding[0]); avoided > 0 {
+		w.stats.onSackAvoided(avoided)
+	}
+	for i, seq := range outstanding {
+		p, ok := w.inflight[seq]
+		if !ok {
+			// Abandoned with its message
+			continue
+		}
+		p.fast = false
+		if !w.resend(seq, p, i == 0, false) && w.err != nil {
+			return
+		}
+	}
+	if len(w.inflight) > 0 {
+		w.startTimer()
+	}
+}
+
+// handleNack fast retransmits the outstanding packets a NACK reports
+// missing. In ModeGoBackN everything from the first of them onwards is sent
+// again, as on a timeout. A packet is fast retransmitted at most once until
+// its timer expires, and no retry is charged.
+func (w *sendWindow) handleNack(missing []sackRange) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if !w.cfg.FastRetransmit || w.err != nil || w.closed {
+		return
+	}
+
+	var resend []int64
+	for _, seq := range w.outstanding() {
+		if containsSeq(missing, seq) && !w.inflight[seq].fast {
+			resend = append(resend, seq)
+		}
+	}
+	if len(resend) == 0 {
+		return
+	}
+	w.onLoss(w.inflight[resend[0]])
+
+	if w.cfg.Mode == ModeGoBackN {
+		resend = resend[:0]
+		for _, seq := range w.outstanding() {
+			if seq >= missing[0].start {
+				resend = append(resend, seq)
+			}
+		}
+	}
+	for _, seq := range resend {
+		p := w.inflight[seq]
+		if containsSeq(missing, seq) {
+			p.fast = true
+		}
+		if !w.resend(seq, p, false, true) {
+			return
+		}
+		if p.timer != nil {
+			p.timer.Reset(p.policy.Delay(p.retries, w.rtt.RTO()))
+		}
+	}
+	if w.cfg.Mode == ModeGoBackN && len(w.inflight) > 0 {
+		w.startTimer()
+	}
+}
+
+// handleResync answers a receiver that has no state for this sender, such
+// as a Server whose session for it was reaped. The oldest outstanding
+// packet gets FlagResync, so that the receiver can start from it, and is
+// resent at once; later packets follow on their timers. No retry is charged.
+func (w *sendWindow) handleResync(seq int64) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if w.err != nil || w.closed {
+		return
+	}
+	if _, ok := w.inflight[seq]; !ok {
+		return
+	}
+	oldest := w.outstanding()[0]
+	w.flagResync(oldest, w.inflight[oldest])
+}
+
+// flagResync adds FlagResync to packet seq, which must be the oldest
+// outstanding one, and resends it at once without charging a retry.
+// Caller must hold w.mu.
+func (w *sendWindow) flagResync(seq int64, p *inflightPacket) {
+	if p.resync {
+		// Already flagged; its timer resends it if this copy is lost
+		return
+	}
+	h, payload, err := DecodePacket(p.wire)
+	if err != nil {
+		return
+	}
+	h.Flags |= FlagResync
+	p.wire = EncodePacket(h, payload)
+	p.resync = true
+	w.resend(seq, p, false, false)
+}
+
+// abandon gives up on message m because of cause, reporting how far its
+// oldest unacknowledged packet got
+func (w *sendWindow) abandon(m *windowMessage, cause error) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if m.finished {
+		return
+	}
+	err := fmt.Errorf("message abandoned before it was sent: %w", cause)
+	for _, seq := range m.seqs {
+		if p, ok := w.inflight[seq]; ok {
+			err = fmt.Errorf("packet %d abandoned after %d attempts: %w", seq, p.retries+1, cause)
+			break
+		}
+	}
+	w.abandonLocked(m, err)
+}
+
+// abandonLocked ends m with err. Its unacknowledged packets are no longer
+// retransmitted, and the receiver is told to skip over them once nothing
+// below them is outstanding. Caller must hold w.mu.
+func (w *sendWindow) abandonLocked(m *windowMessage, err error) {
+	if m.finished {
+		return
+	}
+	w.finishLocked(m, err)
+	for _, seq := range m.seqs {
+		p, ok := w.inflight[seq]
+		if !ok {
+			continue
+		}
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(w.inflight, seq)
+		w.inflightBytes -= len(p.wire) - HeaderSize
+		if seq > w.gap {
+			w.gap = seq
+		}
+	}
+	if w.cfg.Mode == ModeGoBackN && w.timer != nil {
+		if len(w.inflight) > 0 {
+			w.startTimer()
+		} else {
+			w.timer.Stop()
+		}
+	}
+	w.resyncGap()
+	w.cond.Broadcast()
+}
+
+// resyncGap lets the receiver skip the packets of abandoned messages. Once
+// no outstanding packet is below the highest of them, the oldest outstanding
+// packet is resent with FlagResync, or the next packet carries it if
+// nothing is outstanding. Caller must hold w.mu.
+func (w *sendWindow) resyncGap() {
+	if w.gap == 0 {
+		return
+	}
+	if len(w.inflight) == 0 {
+		w.gap = 0
+		w.started = false
+		return
+	}
+	oldest := w.outstanding()[0]
+	if oldest < w.gap {
+		return
+	}
+	w.gap = 0
+	w.flagResync(oldest, w.inflight[oldest])
+}
+
+// resend transmits p again, charging the retry to its budget if charge is
+// set, and counts it as a fast or timeout retransmission. It fails the
+// sender and returns false once the budget is used up. Caller must hold w.mu.
+func (w *sendWindow) resend(seq int64, p *inflightPacket, charge, fast bool) bool {
+	if charge && p.policy.Exhausted(p.retries+1, time.Since(p.sentAt)) {
+		w.stats.onLost()
+
+		err := fmt.Errorf("max retries exceeded for packet %d", seq)
+		if p.msg != nil {
+			// Only this message fails; later ones may still get through
+			w.abandonLocked(p.msg, err)
+			return false
+		}
+		w.fail(err)
+		return false
+	}
+	if charge {
+		p.retries++
+		if p.retries >= 2 {
+			// The path may have stopped carrying packets this large; only
+			// the probes that follow decide
+			w.pmtuSuspect(len(p.wire) - HeaderSize)
+		}
+	}
+	p.resent = true
+
+	w.stats.onRetransmit(w.cfg.Mode, len(p.wire)-HeaderSize, fast)
+
+	if err := w.write(p.wire); err != nil {
+		if isMessageTooLong(err) && w.pmtu.enabled {
+			// Lost like on the path, but packets are made smaller
+			w.pmtuRefusedLocked(w.pmtu.datagramSize(p.wire))
+			return true
+		}
+		w.fail(fmt.Errorf("send error: %v", err))
+		return false
+	}
+	return true
+}
+
+// sackedAbove counts the packets above seq that SACK retired, which plain
+// Go-Back-N would have resent. Caller must hold w.mu.
+func (w *sendWindow) sackedAbove(seq int64) int {
+	n := 0
+	for s := range w.sacked {
+		if s > seq {
+			n++
+		}
+	}
+	return n
+}
+
+// outstanding returns the unacknowledged sequence numbers in ascending order.
+// Caller must hold w.mu.
+func (w *sendWindow) outstanding() []int64 {
+	seqs := make([]int64, 0, len(w.inflight))
+	for seq := range w.inflight {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// startTimer (re)arms the Go-Back-N timer for the oldest outstanding
+// packet. Caller must hold w.mu.
+func (w *sendWindow) startTimer() {
+	base := w.inflight[w.outstanding()[0]]
+	delay := base.policy.Delay(base.retries, w.rtt.RTO())
+	if w.timer == nil {
+		w.timer = time.AfterFunc(delay, w.goBackN)
+		return
+	}
+	w.timer.Reset(delay)
+}
+
+// stopTimers disarms all retransmit timers. Caller must hold w.mu.
+func (w *sendWindow) stopTimers() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.probeTimer != nil {
+		w.probeTimer.Stop()
+	}
+	if w.fec.timer != nil {
+		w.fec.timer.Stop()
+	}
+	if w.pmtu.timer != nil {
+		w.pmtu.timer.Stop()
+	}
+	for _, p := range w.inflight {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+	}
+}
+
+// fail records the first fatal error and wakes all waiters.
+// Caller must hold w.mu.
+func (w *sendWindow) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+	w.stopTimers()
+	w.finishAllLocked(w.err)
+	w.cond.Broadcast()
+}
+
+// handleAck retires acknowledged packets and opens the window. In
+// ModeGoBackN, or if the receiver's ACK policy made it cumulative, the ACK
+// retires everything up to seq together with the packets in info's SACK
+// ranges. The receive window
+// advertised in info replaces the previous one.
+func (w *sendWindow) handleAck(seq int64, info ackInfo) {
+	w.mu.Lock()
+	defer w.unlock()
+
+	if info.window >= 0 && info.window != w.peerWindow {
+		w.peerWindow = info.window
+		if info.window > 0 {
+			w.probes = 0
+			w.probeAt = time.Time{}
+		}
+		w.cond.Broadcast()
+	}
+
+	acked := []int64{seq}
+	if w.cfg.Mode == ModeGoBackN || info.cumulative {
+		acked = acked[:0]
+		for _, s := range w.outstanding() {
+			switch {
+			case s <= seq:
+				acked = append(acked, s)
+			case containsSeq(info.sack, s):
+				acked = append(acked, s)
+				if w.cfg.Mode == ModeGoBackN {
+					w.sacked[s] = true
+				}
+			}
+		}
+		for s := range w.sacked {
+			if s <= seq {
+				delete(w.sacked, s)
+			}
+		}
+	}
+
+	// The sender left the window unused if it had fewer packets in flight
+	// than cwnd and nothing waiting to be sent, or if cwnd already admits
+	// WindowSize packets
+	appLimited := false
+	if w.cc != nil {
+		cwnd := w.cc.Window()
+		appLimited = cwnd >= w.cfg.WindowSize || w.blocked == 0 && len(w.inflight) < cwnd
+	}
+
+	retired := 0
+	for _, s := range acked {
+		p, ok := w.inflight[s]
+		if !ok {
+			continue
+		}
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(w.inflight, s)
+		w.inflightBytes -= len(p.wire) - HeaderSize
+		retired++
+		if m := p.msg; m != nil {
+			m.pending--
+			if m.pending == 0 && m.sent {
+				w.finishLocked(m, nil)
+			}
+		}
+
+		now := time.Now()
+		rtt := now.Sub(p.sentAt)
+		sample := time.Duration(0)
+		if s == seq && !p.resent {
+			// Karn's algorithm: only unambiguous samples update the RTO
+			w.rtt.sample(rtt, info.delay)
+			sample = rtt
+		}
+
+		w.stats.onAcked(len(p.wire)-HeaderSize, rtt)
+
+		w.delivered += int64(len(p.wire))
+		w.deliveredAt = now
+		if w.cc != nil {
+			var rate float64
+			if interval := now.Sub(p.deliveredAt); interval > 0 {
+				rate = float64(w.delivered-p.delivered) / interval.Seconds()
+			}
+			w.cc.OnAck(AckEvent{
+				Now:          now,
+				SentAt:       p.sentAt,
+				Bytes:        len(p.wire),
+				RTT:          sample,
+				DeliveryRate: rate,
+				Inflight:     len(w.inflight),
+				AppLimited:   appLimited,
+			})
+			w.traceCwnd(false)
+		}
+	}
+	if retired == 0 {
+		return
+	}
+	w.resyncGap()
+
+	if w.cfg.Mode == ModeGoBackN {
+		if len(w.inflight) > 0 {
+			w.startTimer()
+		} else {
+			w.timer.Stop()
+		}
+	}
+	w.cond.Broadcast()
+}
+
+// WindowSender keeps up to Config.WindowSize packets in flight on a
+// connected socket, using the retransmission strategy of Config.Mode.
+//
+// The sender reads ACKs from conn in a background goroutine, so conn must not
+// be used for SendReliable while a WindowSender is open on it.
+type WindowSender struct {
+	conn       *net.UDPConn
+	io         *batchConn
+	crypto     *packetCrypto
+	w          *sendWindow
+	readerDone chan struct{}
+}
+
+// NewWindowSender starts a windowed sender on conn using cfg.Mode. Packets
+// are sealed with cfg.Cipher and cfg.Key; if those are invalid, every Send
+// fails. With cfg.PathMTUDiscovery, conn is switched to setting the DF bit.
+func NewWindowSender(conn *net.UDPConn, cfg Config) *WindowSender {
+	pc, cryptoErr := newPacketCrypto(cfg)
+	io := newBatchConn(conn, cfg.normalize().BatchSize)
+	write := func(b []byte) error {
+		return io.write(pc.seal(b, cfg.Checksum), nil)
+	}
+	nextSeq := func() int64 { return nextSequence(conn) }
+
+	ws := &WindowSender{
+		conn:       conn,
+		io:         io,
+		crypto:     pc,
+		w:          newSendWindow(cfg, endpointFor(conn).stats, write, nextSeq, true),
+		readerDone: make(chan struct{}),
+	}
+	io.refused = func(p []byte, _ *net.UDPAddr, err error) {
+		if isMessageTooLong(err) {
+			ws.w.pmtuRefused(len(p))
+		}
+	}
+	if cryptoErr != nil {
+		ws.w.mu.Lock()
+		ws.w.fail(cryptoErr)
+		ws.w.mu.Unlock()
+	}
+	if remote, ok := conn.RemoteAddr().(*net.UDPAddr); ok && cfg.PathMTUDiscovery && setDontFragment(conn) == nil {
+		ws.w.startPMTU(remote, pc != nil)
+	}
+	go ws.readAcks()
+	return ws
+}
+
+// RTO returns the sender's current retransmission timeout
+func (ws *WindowSender) RTO() time.Duration {
+	return ws.w.rtt.RTO()
+}
+
+// SRTT returns the sender's smoothed round-trip time
+func (ws *WindowSender) SRTT() time.Duration {
+	return ws.w.rtt.SRTT()
+}
+
+// Send queues data for transmission, blocking while the window is full.
+// Messages larger than MaxPacketSize are split into fragments. It returns
+// once the last packet is on the wire; use Flush to wait for the ACKs.
+func (ws *WindowSender) Send(data []byte) error {
+	return ws.w.send(data, 0, ws.w.cfg.RetryPolicy, nil)
+}
+
+// SendWithPolicy is like Send but retransmits this message according to
+// policy instead of the connection's retry policy
+func (ws *WindowSender) SendWithPolicy(data []byte, policy RetryPolicy) error {
+	return ws.w.send(data, 0, policy, nil)
+}
+
+// CwndTrace returns the congestion window changes recorded so far. It is
+// empty unless Config.TraceCwnd is set and a congestion controller is used.
+func (ws *WindowSender) CwndTrace() []CwndSample {
+	return ws.w.cwndTrace()
+}
+
+// Flush blocks until every sent packet is acknowledged or the sender fails
+func (ws *WindowSender) Flush() error {
+	return ws.w.flush()
+}
+
+// Close flushes outstanding packets and stops the ACK reader.
+// conn itself is left open.
+func (ws *WindowSender) Close() error {
+	err := ws.w.flush()
+	ws.w.stop(ErrSenderClosed)
+	ws.io.close()
+
+	// Unblock the reader, then make conn usable for plain reads again
+	ws.conn.SetReadDeadline(time.Now())
+	<-ws.readerDone
+	ws.conn.SetReadDeadline(time.Time{})
+
+	return err
+}
+
+// readAcks consumes ACKs from conn until the sender is closed
+func (ws *WindowSender) readAcks() {
+	defer close(ws.readerDone)
+
+	for {
+		ms, err := ws.io.read()
+		if err != nil {
+			ws.w.mu.Lock()
+			if !ws.w.closed {
+				ws.w.fail(fmt.Errorf("read error: %v", err))
+			}
+			ws.w.mu.Unlock()
+			return
+		}
+
+		for _, m := range ms {
+			header, payload, err := decodeReceived(m.Buffers[0][:m.N], ws.w.cfg.Checksum, ws.w.stats, ws.crypto)
+			if err != nil {
+				continue
+			}
+			switch header.Type {
+			case PacketAck:
+				ws.w.handleAck(header.SequenceNumber, decodeAck(header, payload))
+			case PacketNack:
+				ws.w.handleNack(decodeNack(header, payload))
+			case PacketProbeAck:
+				ws.w.handleProbeAck(header.SequenceNumber)
+			case PacketResync:
+				ws.w.handleResync(header.SequenceNumber)
+			}
+		}
+	}
+}
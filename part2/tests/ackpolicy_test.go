@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"part2/reliable_udp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// transfer sends count messages of size bytes through a WindowSender and
+// returns them as the receiver read them
+func transfer(t testing.TB, receiver, sender *net.UDPConn, cfg reliable_udp.Config, count, size int) []string {
+	t.Helper()
+
+	msgs := make(chan string, count)
+	go func() {
+		for {
+			data, _, err := reliable_udp.ReceiveReliable(receiver)
+			if err == nil {
+				msgs <- string(data)
+			} else if strings.HasPrefix(err.Error(), "read error") {
+				return
+			}
+		}
+	}()
+
+	ws := reliable_udp.NewWindowSender(sender, cfg)
+	payload := strings.Repeat("x", size)
+	for i := 0; i < count; i++ {
+		if err := ws.Send([]byte(fmt.Sprintf("%06d%s", i, payload[6:]))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if err := ws.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	got := make([]string, 0, count)
+	for len(got) < count {
+		select {
+		case msg := <-msgs:
+			got = append(got, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Received only %d of %d messages", len(got), count)
+		}
+	}
+	return got
+}
+
+func TestAckPolicies(t *testing.T) {
+	const count = 200
+	// Retransmissions are ACKed too, so the counts are bounds
+	for _, tc := range []struct {
+		policy           reliable_udp.AckPolicy
+		minAcks, maxAcks int
+	}{
+		{reliable_udp.AckImmediate, count, 2 * count},
+		{reliable_udp.AckEveryN, 1, count / 2},
+		{reliable_udp.AckDelayed, 1, count / 2},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			cfg := reliable_udp.Config{
+				WindowSize: 32,
+				AckPolicy:  tc.policy,
+				AckEvery:   4,
+				AckDelay:   50 * time.Millisecond,
+			}
+			reliable_udp.Configure(receiver, cfg)
+
+			got := transfer(t, receiver, sender, cfg, count, 100)
+			for i, msg := range got {
+				if want := fmt.Sprintf("%06d", i); msg[:6] != want {
+					t.Fatalf("Message %d starts with %q, want %q", i, msg[:6], want)
+				}
+			}
+
+			recv := reliable_udp.GetConnStatistics(receiver)
+			if recv.AcksSent < tc.minAcks || recv.AcksSent > tc.maxAcks {
+				t.Errorf("AcksSent = %d, want %d..%d", recv.AcksSent, tc.minAcks, tc.maxAcks)
+			}
+			// The reported ACK delay is taken out of the RTT samples
+			if srtt := reliable_udp.GetConnStatistics(sender).SRTT; srtt >= 25*time.Millisecond {
+				t.Errorf("SRTT = %v, want ACK delay excluded", srtt)
+			}
+		})
+	}
+}
+
+func TestAckDelayDoesNotStickInRTO(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+	reliable_udp.Configure(receiver, reliable_udp.Config{
+		AckPolicy: reliable_udp.AckDelayed,
+		AckDelay:  60 * time.Millisecond,
+	})
+	go func() {
+		for {
+			_, _, err := reliable_udp.ReceiveReliable(receiver)
+			if err != nil && strings.HasPrefix(err.Error(), "read error") {
+				return
+			}
+		}
+	}()
+
+	// A low floor, so the RTO can drop below the ACK delay again
+	ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{MinRTO: time.Millisecond})
+	defer ws.Close()
+	send := func() {
+		t.Helper()
+		if err := ws.Send([]byte("x")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		if err := ws.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+
+	// Held back for less than the initial RTO, so the packet is not resent
+	send()
+	if rto := ws.RTO(); rto < 60*time.Millisecond {
+		t.Fatalf("RTO = %v with ACKs held back 60ms, want the delay included", rto)
+	}
+
+	// Once the peer stops holding ACKs back, the RTO follows
+	reliable_udp.Configure(receiver, reliable_udp.Config{AckPolicy: reliable_udp.AckImmediate})
+	for i := 0; i < 40; i++ {
+		send()
+	}
+	if rto := ws.RTO(); rto >= 25*time.Millisecond {
+		t.Errorf("RTO = %v after immediate ACKs, want the old ACK delay forgotten", rto)
+	}
+}
+
+func BenchmarkAckPolicy(b *testing.B) {
+	const size = 1000
+	for _, policy := range []reliable_udp.AckPolicy{
+		reliable_udp.AckImmediate,
+		reliable_udp.AckEveryN,
+		reliable_udp.AckDelayed,
+	} {
+		b.Run(policy.String(), func(b *testing.B) {
+			receiver, sender := newLoopbackPair(b)
+			cfg := reliable_udp.Config{WindowSize: 64, AckPolicy: policy, AckEvery: 8}
+			reliable_udp.Configure(receiver, cfg)
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			transfer(b, receiver, sender, cfg, b.N, size)
+			b.StopTimer()
+
+			acks := reliable_udp.GetConnStatistics(receiver).AcksSent
+			b.ReportMetric(float64(acks)/float64(b.N), "acks/msg")
+		})
+	}
+}
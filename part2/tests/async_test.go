@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"part2/reliable_udp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newDelayRelay forwards datagrams between one client and target, holding
+// each back for delay in either direction
+func newDelayRelay(t *testing.T, target *net.UDPAddr, delay time.Duration) *net.UDPAddr {
+	t.Helper()
+
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	back, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			client.Store(addr)
+			b := append([]byte(nil), buf[:n]...)
+			time.AfterFunc(delay, func() { back.Write(b) })
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := back.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			if addr := client.Load(); addr != nil {
+				b := append([]byte(nil), buf[:n]...)
+				time.AfterFunc(delay, func() { front.WriteToUDP(b, addr) })
+			}
+		}
+	}()
+	return front.LocalAddr().(*net.UDPAddr)
+}
+
+func TestSendAsyncDeliversInOrder(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+
+	const count = 20
+	var got []string
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+		got, recvErr = receiveAll(count, func() ([]byte, error) {
+			data, _, err := reliable_udp.ReceiveReliable(receiver)
+			return data, err
+		})
+	}()
+
+	var callbacks atomic.Int32
+	handles := make([]*reliable_udp.SendHandle, count)
+	for i := range handles {
+		handles[i] = reliable_udp.SendAsync(sender, fmt.Sprintf("msg-%d", i))
+		handles[i].OnComplete(func(rtt time.Duration, err error) {
+			callbacks.Add(1)
+		})
+	}
+
+	for i, h := range handles {
+		rtt, err := h.Wait()
+		if err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+		if rtt <= 0 {
+			t.Errorf("Send %d reported RTT %v", i, rtt)
+		}
+		select {
+		case <-h.Done():
+		default:
+			t.Errorf("Handle %d not done after Wait", i)
+		}
+	}
+	if n := callbacks.Load(); n != count {
+		t.Errorf("Callbacks ran %d times, want %d", n, count)
+	}
+
+	<-done
+	if recvErr != nil {
+		t.Fatalf("Receive failed: %v", recvErr)
+	}
+	for i, msg := range got {
+		if want := fmt.Sprintf("msg-%d", i); msg != want {
+			t.Fatalf("Message %d = %q, want %q", i, msg, want)
+		}
+	}
+
+	// A callback registered after completion runs immediately
+	ran := false
+	handles[0].OnComplete(func(time.Duration, error) { ran = true })
+	if !ran {
+		t.Error("OnComplete on a finished handle did not run")
+	}
+}
+
+func TestSendAsyncContextCancelledWhileQueued(t *testing.T) {
+	// Nobody ACKs, so the first message holds up the queue
+	_, sender := newLoopbackPair(t)
+
+	first, cancelFirst := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFirst()
+	queued, cancelQueued := context.WithCancel(context.Background())
+	cancelQueued()
+
+	h1 := reliable_udp.SendAsyncContext(first, sender, "first")
+	h2 := reliable_udp.SendAsyncContext(queued, sender, "second")
+
+	if _, err := h1.Wait(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("First send error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := h2.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Queued send error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSendAsyncKeepsMessagesInFlight(t *testing.T) {
+	const count, delay = 20, 20 * time.Millisecond
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { receiver.Close() })
+	sender, err := net.DialUDP("udp", nil, newDelayRelay(t, receiver.LocalAddr().(*net.UDPAddr), delay))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { sender.Close() })
+
+	go func() {
+		for {
+			if _, _, err := reliable_udp.ReceiveReliable(receiver); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	handles := make([]*reliable_udp.SendHandle, count)
+	for i := range handles {
+		handles[i] = reliable_udp.SendAsync(sender, fmt.Sprintf("msg-%d", i))
+	}
+	for i, h := range handles {
+		if _, err := h.Wait(); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+
+	// One message at a time would take count round trips
+	rtt := 2 * delay
+	if elapsed := time.Since(start); elapsed > count*rtt/4 {
+		t.Errorf("%d async sends took %v, want well below %v", count, elapsed, count*rtt)
+	}
+}
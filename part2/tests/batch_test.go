@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+func TestBatchIOConn(t *testing.T) {
+	client, server := newConnPair(t, reliable_udp.Config{WindowSize: 64, BatchSize: 16})
+
+	exchangeBothWays(t, client, server, 500)
+
+	msg := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := client.Send(msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Received %d bytes, want the %d sent", len(got), len(msg))
+	}
+}
+
+func TestBatchIOWindowSender(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+	reliable_udp.SetDropRate(5)
+	defer reliable_udp.SetDropRate(0)
+
+	cfg := reliable_udp.Config{WindowSize: 64, BatchSize: 32}
+	got := transfer(t, receiver, sender, cfg, 300, 100)
+	for i, msg := range got {
+		if want := fmt.Sprintf("%06d", i); msg[:6] != want {
+			t.Fatalf("Message %d starts with %q, want %q", i, msg[:6], want)
+		}
+	}
+}
+
+func TestBatchIOServer(t *testing.T) {
+	const count = 300
+	cfg := reliable_udp.Config{WindowSize: 32, BatchSize: 16}
+	s, err := reliable_udp.NewServer("127.0.0.1:0", cfg, nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer s.Close()
+
+	ws := reliable_udp.NewWindowSender(dialServer(t, s), cfg)
+	for i := 0; i < count; i++ {
+		if err := ws.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if err := ws.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	sess, err := s.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	for i := 0; i < count; i++ {
+		data, err := sess.Receive()
+		if err != nil {
+			t.Fatalf("Receive %d failed: %v", i, err)
+		}
+		if want := fmt.Sprintf("msg-%d", i); string(data) != want {
+			t.Fatalf("Message %d = %q, want %q", i, data, want)
+		}
+	}
+}
+
+// BenchmarkBatchIO streams small messages over a Conn, reporting the data
+// packets and ACKs moved per second with per-packet I/O (batch=0) and with
+// batches of several sizes
+func BenchmarkBatchIO(b *testing.B) {
+	const size = 64
+	for _, batch := range []int{0, 8, 32, 64} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			cfg := reliable_udp.Config{
+				WindowSize:  64,
+				MinRTO:      50 * time.Millisecond,
+				RetryPolicy: reliable_udp.RetryPolicy{MaxAttempts: 20},
+				BatchSize:   batch,
+			}
+			client, server := newConnPair(b, cfg)
+
+			done := make(chan error, 1)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := server.Receive(); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+
+			msg := make([]byte, size)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := client.Send(msg); err != nil {
+					b.Fatalf("Send %d failed: %v", i, err)
+				}
+			}
+			if err := <-done; err != nil {
+				b.Fatalf("Receive failed: %v", err)
+			}
+			b.StopTimer()
+
+			packets := client.Statistics().SentPackets + server.Statistics().AcksSent
+			b.ReportMetric(float64(packets)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"fmt"
+	"part2/reliable_udp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCorruptedPacketsAreRetransmitted(t *testing.T) {
+	for _, alg := range []reliable_udp.Checksum{reliable_udp.ChecksumCRC32C, reliable_udp.ChecksumIEEE} {
+		t.Run(alg.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			if err := reliable_udp.Configure(receiver, reliable_udp.Config{Checksum: alg}); err != nil {
+				t.Fatalf("Configure failed: %v", err)
+			}
+			reliable_udp.SetCorruptRate(10)
+			defer reliable_udp.SetCorruptRate(0)
+
+			// Keep reading after the last message, since corrupted ACKs
+			// make the sender retransmit packets the receiver already has
+			const count = 200
+			msgs := make(chan string, count)
+			go func() {
+				for {
+					data, _, err := reliable_udp.ReceiveReliable(receiver)
+					if err == nil {
+						msgs <- string(data)
+					} else if strings.HasPrefix(err.Error(), "read error") {
+						return
+					}
+				}
+			}()
+
+			// Corruption hits ACKs too, so allow for more attempts
+			ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{
+				WindowSize:  16,
+				RetryPolicy: reliable_udp.RetryPolicy{MaxAttempts: 20},
+				Checksum:    alg,
+			})
+			for i := 0; i < count; i++ {
+				if err := ws.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+					t.Fatalf("Send %d failed: %v", i, err)
+				}
+			}
+			if err := ws.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			for i := 0; i < count; i++ {
+				select {
+				case msg := <-msgs:
+					if want := fmt.Sprintf("msg-%d", i); msg != want {
+						t.Fatalf("Message %d = %q, want %q", i, msg, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Received only %d of %d messages", i, count)
+				}
+			}
+
+			corrupt := reliable_udp.GetConnStatistics(receiver).CorruptPackets +
+				reliable_udp.GetConnStatistics(sender).CorruptPackets
+			if corrupt == 0 {
+				t.Error("No corrupted packets were counted")
+			}
+		})
+	}
+}
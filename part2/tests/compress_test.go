@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"part2/reliable_udp"
+	"strings"
+	"testing"
+)
+
+func TestCompressionNegotiated(t *testing.T) {
+	cfg := reliable_udp.Config{
+		Compressors: []reliable_udp.Compressor{reliable_udp.NewFlateCompressor(flate.BestSpeed)},
+	}
+	client, server := newConnPair(t, cfg)
+
+	random := make([]byte, 4000)
+	rand.Read(random)
+	msgs := [][]byte{
+		[]byte(strings.Repeat("compressible ", 1000)),
+		random,
+		[]byte("small"),
+	}
+	for _, msg := range msgs {
+		if err := client.Send(msg); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	for i, want := range msgs {
+		got, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive %d failed: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Message %d differs: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+
+	st := client.Statistics()
+	if st.CompressedMessages != 1 || st.CompressionSkipped != 2 {
+		t.Errorf("CompressedMessages = %d, CompressionSkipped = %d, want 1 and 2",
+			st.CompressedMessages, st.CompressionSkipped)
+	}
+	if st.CompressionRatio < 10 {
+		t.Errorf("CompressionRatio = %.1f, want at least 10", st.CompressionRatio)
+	}
+	if st.CompressTime <= 0 {
+		t.Error("CompressTime was not recorded")
+	}
+	if server.Statistics().DecompressTime <= 0 {
+		t.Error("DecompressTime was not recorded")
+	}
+}
+
+func TestCompressionNeedsBothEnds(t *testing.T) {
+	l, err := reliable_udp.Listen("127.0.0.1:0", reliable_udp.Config{})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	client, err := reliable_udp.Dial(l.Addr().String(), reliable_udp.Config{
+		Compressors: []reliable_udp.Compressor{reliable_udp.NewFlateCompressor(flate.DefaultCompression)},
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+
+	msg := []byte(strings.Repeat("a", 2000))
+	if err := client.Send(msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Received %d bytes, want %d", len(got), len(msg))
+	}
+	if n := client.Statistics().CompressedMessages; n != 0 {
+		t.Errorf("CompressedMessages = %d without a compressor on the listener", n)
+	}
+}
@@ -0,0 +1,268 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+func TestCongestionControlDeliversUnderLoss(t *testing.T) {
+	for _, cc := range []reliable_udp.Congestion{
+		reliable_udp.CongestionReno,
+		reliable_udp.CongestionCubic,
+		reliable_udp.CongestionBBR,
+	} {
+		t.Run(cc.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			reliable_udp.SetDropRate(5)
+			defer reliable_udp.SetDropRate(0)
+
+			const count = 300
+			var got []string
+			var recvErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+				got, recvErr = receiveAll(count, func() ([]byte, error) {
+					data, _, err := reliable_udp.ReceiveReliable(receiver)
+					return data, err
+				})
+			}()
+
+			ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{
+				WindowSize: 64,
+				Congestion: cc,
+				TraceCwnd:  true,
+			})
+			for i := 0; i < count; i++ {
+				if err := ws.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+					t.Fatalf("Send %d failed: %v", i, err)
+				}
+			}
+			if err := ws.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			<-done
+			if recvErr != nil {
+				t.Fatalf("Receive failed: %v", recvErr)
+			}
+			for i, msg := range got {
+				if want := fmt.Sprintf("msg-%d", i); msg != want {
+					t.Fatalf("Message %d = %q, want %q", i, msg, want)
+				}
+			}
+			if len(ws.CwndTrace()) == 0 {
+				t.Error("Congestion window trace is empty")
+			}
+		})
+	}
+}
+
+func TestRenoAIMD(t *testing.T) {
+	r := reliable_udp.NewReno()
+	start := time.Now()
+
+	for i := 0; i < 10; i++ {
+		r.OnAck(reliable_udp.AckEvent{Now: start})
+	}
+	if got := r.Window(); got != 2*reliable_udp.InitialCwnd {
+		t.Fatalf("Window after slow start = %d, want %d", got, 2*reliable_udp.InitialCwnd)
+	}
+
+	lossAt := start.Add(time.Second)
+	r.OnLoss(reliable_udp.LossEvent{Now: lossAt, SentAt: start.Add(time.Millisecond)})
+	if got := r.Window(); got != reliable_udp.InitialCwnd {
+		t.Fatalf("Window after loss = %d, want %d", got, reliable_udp.InitialCwnd)
+	}
+
+	// A second loss from the same window is not another congestion signal
+	r.OnLoss(reliable_udp.LossEvent{Now: lossAt, SentAt: start.Add(2 * time.Millisecond)})
+	if got := r.Window(); got != reliable_udp.InitialCwnd {
+		t.Fatalf("Window after loss in recovery = %d, want %d", got, reliable_udp.InitialCwnd)
+	}
+
+	// Congestion avoidance grows by about one packet per window
+	for i := 0; i <= reliable_udp.InitialCwnd; i++ {
+		r.OnAck(reliable_udp.AckEvent{Now: lossAt})
+	}
+	if got := r.Window(); got != reliable_udp.InitialCwnd+1 {
+		t.Errorf("Window after one window of ACKs = %d, want %d", got, reliable_udp.InitialCwnd+1)
+	}
+}
+
+func TestCubicReducesByBeta(t *testing.T) {
+	c := reliable_udp.NewCubic()
+	start := time.Now()
+	for i := 0; i < 90; i++ {
+		c.OnAck(reliable_udp.AckEvent{Now: start, RTT: time.Millisecond})
+	}
+	c.OnLoss(reliable_udp.LossEvent{Now: start.Add(time.Second), SentAt: start.Add(time.Millisecond)})
+	if got := c.Window(); got != 70 {
+		t.Errorf("Window after loss at 100 = %d, want 70", got)
+	}
+}
+
+func TestAppLimitedAcksDoNotGrowWindow(t *testing.T) {
+	now := time.Now()
+	for _, cc := range []reliable_udp.CongestionController{reliable_udp.NewReno(), reliable_udp.NewCubic()} {
+		for i := 0; i < 100; i++ {
+			cc.OnAck(reliable_udp.AckEvent{Now: now, RTT: time.Millisecond, AppLimited: true})
+		}
+		if got := cc.Window(); got != reliable_udp.InitialCwnd {
+			t.Errorf("%T window after app-limited ACKs = %d, want %d", cc, got, reliable_udp.InitialCwnd)
+		}
+	}
+}
+
+func TestSenderWithOnePacketInFlightIsAppLimited(t *testing.T) {
+	for _, cc := range []reliable_udp.Congestion{reliable_udp.CongestionReno, reliable_udp.CongestionCubic} {
+		t.Run(cc.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			go func() {
+				for {
+					if _, _, err := reliable_udp.ReceiveReliable(receiver); err != nil {
+						return
+					}
+				}
+			}()
+
+			ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{
+				WindowSize: 64,
+				Congestion: cc,
+				TraceCwnd:  true,
+			})
+			defer ws.Close()
+			// Never more than one packet in flight, far below the window
+			for i := 0; i < 50; i++ {
+				if err := ws.Send([]byte("x")); err != nil {
+					t.Fatalf("Send %d failed: %v", i, err)
+				}
+				if err := ws.Flush(); err != nil {
+					t.Fatalf("Flush %d failed: %v", i, err)
+				}
+			}
+			for _, s := range ws.CwndTrace() {
+				if s.Cwnd > reliable_udp.InitialCwnd {
+					t.Fatalf("Congestion window grew to %d with one packet in flight", s.Cwnd)
+				}
+			}
+		})
+	}
+}
+
+func TestLossLowersWindowBelowWindowSize(t *testing.T) {
+	for _, cc := range []reliable_udp.Congestion{reliable_udp.CongestionReno, reliable_udp.CongestionCubic} {
+		t.Run(cc.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			const count, windowSize = 400, 16
+			done := make(chan error)
+			go func() {
+				receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+				_, err := receiveAll(count, func() ([]byte, error) {
+					data, _, err := reliable_udp.ReceiveReliable(receiver)
+					return data, err
+				})
+				done <- err
+			}()
+
+			ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{
+				WindowSize: windowSize,
+				Congestion: cc,
+				TraceCwnd:  true,
+				MinRTO:     20 * time.Millisecond,
+			})
+			// Grow the window well past the cap before any loss
+			for i := 0; i < 300; i++ {
+				if err := ws.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+					t.Fatalf("Send %d failed: %v", i, err)
+				}
+			}
+			reliable_udp.SetDropRate(10)
+			defer reliable_udp.SetDropRate(0)
+			for i := 300; i < count; i++ {
+				if err := ws.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+					t.Fatalf("Send %d failed: %v", i, err)
+				}
+			}
+			if err := ws.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("Receive failed: %v", err)
+			}
+
+			lost := false
+			for _, s := range ws.CwndTrace() {
+				if s.Cwnd > windowSize {
+					t.Fatalf("Congestion window grew to %d past WindowSize %d", s.Cwnd, windowSize)
+				}
+				if s.Loss {
+					lost = true
+					if s.Cwnd >= windowSize {
+						t.Errorf("Window after loss = %d, want below WindowSize %d", s.Cwnd, windowSize)
+					}
+				}
+			}
+			if !lost {
+				t.Error("No loss recorded")
+			}
+		})
+	}
+}
+
+// fixedWindow is a custom controller that allows one packet in flight
+type fixedWindow struct{ acks int }
+
+func (f *fixedWindow) OnAck(reliable_udp.AckEvent)   { f.acks++ }
+func (f *fixedWindow) OnLoss(reliable_udp.LossEvent) {}
+func (f *fixedWindow) Window() int                   { return 1 }
+func (f *fixedWindow) PacingRate() float64           { return 0 }
+
+func TestCustomCongestionController(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+	go func() {
+		for {
+			if _, _, err := reliable_udp.ReceiveReliable(receiver); err != nil {
+				return
+			}
+		}
+	}()
+
+	cc := &fixedWindow{}
+	ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{
+		NewCongestionController: func() reliable_udp.CongestionController { return cc },
+	})
+	for i := 0; i < 10; i++ {
+		if err := ws.Send([]byte("x")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if err := ws.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if cc.acks != 10 {
+		t.Errorf("Controller saw %d ACKs, want 10", cc.acks)
+	}
+}
+
+func TestWriteCwndTrace(t *testing.T) {
+	var buf bytes.Buffer
+	err := reliable_udp.WriteCwndTrace(&buf, []reliable_udp.CwndSample{
+		{Time: 1500 * time.Microsecond, Cwnd: 12, Inflight: 3},
+		{Time: 3 * time.Millisecond, Cwnd: 6, Inflight: 6, Loss: true},
+	})
+	if err != nil {
+		t.Fatalf("WriteCwndTrace failed: %v", err)
+	}
+
+	want := "time_ms,cwnd,pacing_rate,inflight,loss\n" +
+		"1.500,12,0,3,false\n" +
+		"3.000,6,0,6,true\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Trace CSV:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+// newConnPair returns a dialed connection and the listener-side connection
+// accepted for it
+func newConnPair(t testing.TB, cfg reliable_udp.Config) (*reliable_udp.Conn, *reliable_udp.Conn) {
+	t.Helper()
+
+	l, err := reliable_udp.Listen("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	client, err := reliable_udp.Dial(l.Addr().String(), cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return client, server
+}
+
+func TestConnHandshake(t *testing.T) {
+	client, server := newConnPair(t, reliable_udp.Config{})
+
+	if got := client.State(); got != reliable_udp.StateEstablished {
+		t.Errorf("Client state = %v, want %v", got, reliable_udp.StateEstablished)
+	}
+	if got := server.State(); got != reliable_udp.StateEstablished {
+		t.Errorf("Server state = %v, want %v", got, reliable_udp.StateEstablished)
+	}
+	if client.LocalAddr().String() != server.RemoteAddr().String() {
+		t.Errorf("Server sees client as %v, want %v", server.RemoteAddr(), client.LocalAddr())
+	}
+}
+
+func TestConnExchangeUnderLoss(t *testing.T) {
+	client, server := newConnPair(t, reliable_udp.Config{WindowSize: 16})
+	reliable_udp.SetDropRate(10)
+	defer reliable_udp.SetDropRate(0)
+
+	const count = 100
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			data, err := server.Receive()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if want := fmt.Sprintf("msg-%d", i); string(data) != want {
+				errs <- fmt.Errorf("message %d = %q, want %q", i, data, want)
+				return
+			}
+			if err := server.Send(data); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- server.Flush()
+	}()
+
+	for i := 0; i < count; i++ {
+		if err := client.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		data, err := client.Receive()
+		if err != nil {
+			t.Fatalf("Receive %d failed: %v", i, err)
+		}
+		if want := fmt.Sprintf("msg-%d", i); string(data) != want {
+			t.Fatalf("Echo %d = %q, want %q", i, data, want)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Server failed: %v", err)
+	}
+}
+
+func TestConnCloseDeliversEOF(t *testing.T) {
+	client, server := newConnPair(t, reliable_udp.Config{})
+
+	if err := client.Send([]byte("last words")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got := client.State(); got != reliable_udp.StateClosed {
+		t.Errorf("Client state = %v, want %v", got, reliable_udp.StateClosed)
+	}
+
+	data, err := server.Receive()
+	if err != nil || string(data) != "last words" {
+		t.Fatalf("Receive = %q, %v; want %q", data, err, "last words")
+	}
+	if _, err := server.Receive(); err != io.EOF {
+		t.Fatalf("Receive after close = %v, want io.EOF", err)
+	}
+	if got := server.State(); got != reliable_udp.StateCloseWait {
+		t.Errorf("Server state = %v, want %v", got, reliable_udp.StateCloseWait)
+	}
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	// A bound socket that never answers
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	_, err = reliable_udp.Dial(silent.LocalAddr().String(), reliable_udp.Config{
+		HandshakeTimeout: 200 * time.Millisecond,
+	})
+	if !errors.Is(err, reliable_udp.ErrHandshakeTimeout) {
+		t.Fatalf("Dial error = %v, want %v", err, reliable_udp.ErrHandshakeTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Dial took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestListenerBoundsHalfOpenConns(t *testing.T) {
+	l, err := reliable_udp.Listen("127.0.0.1:0", reliable_udp.Config{
+		MaxPending:       2,
+		HandshakeTimeout: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	// SYNs that are never followed by the handshake ACK
+	syn := reliable_udp.EncodePacket(reliable_udp.Header{
+		Type:           reliable_udp.PacketSyn,
+		SequenceNumber: 1,
+		Timestamp:      time.Now(),
+	}, nil)
+	answered := 0
+	for i := 0; i < 3; i++ {
+		peer, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer peer.Close()
+		if _, err := peer.Write(syn); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		buf := make([]byte, 2048)
+		peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, err := peer.Read(buf); err == nil {
+			if h, _, err := reliable_udp.DecodePacket(buf[:n]); err == nil && h.Type == reliable_udp.PacketSynAck {
+				answered++
+			}
+		}
+	}
+	if answered != 2 {
+		t.Errorf("%d SYNs answered, want 2", answered)
+	}
+
+	// Once the half-open connections time out, handshakes succeed again
+	time.Sleep(400 * time.Millisecond)
+	client, err := reliable_udp.Dial(l.Addr().String(), reliable_udp.Config{})
+	if err != nil {
+		t.Fatalf("Dial after the half-open connections expired failed: %v", err)
+	}
+	client.Close()
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"part2/reliable_udp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendReliableContextDeadline(t *testing.T) {
+	// Nobody reads from receiver, so no ACK ever arrives
+	_, sender := newLoopbackPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := reliable_udp.SendReliableContext(ctx, sender, "hello")
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SendReliableContext error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !strings.Contains(err.Error(), "attempts") {
+		t.Errorf("Error %q does not report the attempt count", err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("SendReliableContext took %v, want about 150ms", elapsed)
+	}
+}
+
+func TestSendReliableContextCancel(t *testing.T) {
+	_, sender := newLoopbackPair(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := reliable_udp.SendReliableContext(ctx, sender, "hello")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendReliableContext error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("SendReliableContext took %v after cancel at 50ms", elapsed)
+	}
+}
+
+func TestSendReliableContextDelivers(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+
+	received := make(chan string, 1)
+	go func() {
+		data, _, err := reliable_udp.ReceiveReliableContext(context.Background(), receiver)
+		if err == nil {
+			received <- string(data)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := reliable_udp.SendReliableContext(ctx, sender, "hello"); err != nil {
+		t.Fatalf("SendReliableContext failed: %v", err)
+	}
+	if got := <-received; got != "hello" {
+		t.Errorf("Received %q, want %q", got, "hello")
+	}
+}
+
+func TestReceiveReliableContextCancel(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, _, err = reliable_udp.ReceiveReliableContext(ctx, receiver)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ReceiveReliableContext error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestConnReceiveContextDeadline(t *testing.T) {
+	_, server := newConnPair(t, reliable_udp.Config{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := server.ReceiveContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReceiveContext error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+var ciphers = []reliable_udp.Cipher{
+	reliable_udp.CipherAESGCM,
+	reliable_udp.CipherChaCha20Poly1305,
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, reliable_udp.KeySize)
+}
+
+func TestEncryptedConnUnderLoss(t *testing.T) {
+	for _, c := range ciphers {
+		t.Run(c.String(), func(t *testing.T) {
+			client, server := newConnPair(t, reliable_udp.Config{Cipher: c, Key: testKey(1)})
+			reliable_udp.SetDropRate(10)
+			defer reliable_udp.SetDropRate(0)
+
+			const count = 50
+			for i := 0; i < count; i++ {
+				if err := client.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+					t.Fatalf("Send %d failed: %v", i, err)
+				}
+			}
+			for i := 0; i < count; i++ {
+				data, err := server.Receive()
+				if err != nil {
+					t.Fatalf("Receive %d failed: %v", i, err)
+				}
+				if want := fmt.Sprintf("msg-%d", i); string(data) != want {
+					t.Fatalf("Message %d = %q, want %q", i, data, want)
+				}
+			}
+
+			// Retransmissions are sealed anew and must not look like replays
+			for _, st := range []reliable_udp.StatisticsCopy{client.Statistics(), server.Statistics()} {
+				if st.AuthFailures != 0 || st.ReplayedPackets != 0 {
+					t.Errorf("AuthFailures = %d, ReplayedPackets = %d, want 0",
+						st.AuthFailures, st.ReplayedPackets)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptionKeyMismatch(t *testing.T) {
+	l, err := reliable_udp.Listen("127.0.0.1:0", reliable_udp.Config{
+		Cipher: reliable_udp.CipherAESGCM,
+		Key:    testKey(1),
+	})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	_, err = reliable_udp.Dial(l.Addr().String(), reliable_udp.Config{
+		Cipher:           reliable_udp.CipherAESGCM,
+		Key:              testKey(2),
+		HandshakeTimeout: 200 * time.Millisecond,
+	})
+	if !errors.Is(err, reliable_udp.ErrHandshakeTimeout) {
+		t.Fatalf("Dial error = %v, want %v", err, reliable_udp.ErrHandshakeTimeout)
+	}
+
+	_, err = reliable_udp.Dial(l.Addr().String(), reliable_udp.Config{
+		Cipher: reliable_udp.CipherAESGCM,
+		Key:    []byte("short"),
+	})
+	if err == nil {
+		t.Error("Dial with a short key succeeded")
+	}
+}
+
+func TestTamperedAndReplayedPackets(t *testing.T) {
+	// Without a checksum, a flipped bit reaches the AEAD
+	cfg := reliable_udp.Config{
+		Cipher:   reliable_udp.CipherChaCha20Poly1305,
+		Key:      testKey(3),
+		Checksum: reliable_udp.ChecksumNone,
+	}
+	receiver, sender := newLoopbackPair(t)
+	if err := reliable_udp.Configure(receiver, cfg); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	if err := reliable_udp.Configure(sender, cfg); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	// Capture one sealed data packet on its way to the receiver
+	tap, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer tap.Close()
+	capture, err := net.DialUDP("udp", nil, tap.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer capture.Close()
+	if err := reliable_udp.Configure(capture, cfg); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	reliable_udp.SendAsync(capture, "secret")
+
+	buf := make([]byte, 2048)
+	tap.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := tap.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	sealed := append([]byte(nil), buf[:n]...)
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("Sealed packet contains the plaintext")
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	for _, pkt := range [][]byte{tampered, sealed, sealed} {
+		if _, err := tap.WriteToUDP(pkt, receiver.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	data, _, err := reliable_udp.ReceiveReliable(receiver)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if string(data) != "secret" {
+		t.Fatalf("Received %q, want %q", data, "secret")
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if data, _, err := reliable_udp.ReceiveReliable(receiver); err == nil {
+		t.Fatalf("Replayed packet was delivered as %q", data)
+	}
+
+	st := reliable_udp.GetConnStatistics(receiver)
+	if st.AuthFailures != 1 {
+		t.Errorf("AuthFailures = %d, want 1", st.AuthFailures)
+	}
+	if st.ReplayedPackets != 1 {
+		t.Errorf("ReplayedPackets = %d, want 1", st.ReplayedPackets)
+	}
+}
+
+func TestSendersSharingKey(t *testing.T) {
+	cfg := reliable_udp.Config{Cipher: reliable_udp.CipherAESGCM, Key: testKey(5)}
+	receiver, _ := newLoopbackPair(t)
+	if err := reliable_udp.Configure(receiver, cfg); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	const senders = 16
+	handles := make([]*reliable_udp.SendHandle, senders)
+	for i := range handles {
+		sender, err := net.DialUDP("udp", nil, receiver.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { sender.Close() })
+		if err := reliable_udp.Configure(sender, cfg); err != nil {
+			t.Fatalf("Configure failed: %v", err)
+		}
+		handles[i] = reliable_udp.SendAsync(sender, fmt.Sprintf("sender-%d", i))
+	}
+
+	got := make(map[string]bool)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(got) < senders {
+		data, _, err := reliable_udp.ReceiveReliable(receiver)
+		if err != nil {
+			t.Fatalf("Receive failed after %d messages: %v", len(got), err)
+		}
+		got[string(data)] = true
+	}
+	for i, h := range handles {
+		if _, err := h.Wait(); err != nil {
+			t.Errorf("Send from sender %d failed: %v", i, err)
+		}
+	}
+	if st := reliable_udp.GetConnStatistics(receiver); st.AuthFailures != 0 || st.ReplayedPackets != 0 {
+		t.Errorf("AuthFailures = %d, ReplayedPackets = %d; want 0, 0", st.AuthFailures, st.ReplayedPackets)
+	}
+}
+
+func BenchmarkEncryption(b *testing.B) {
+	for _, c := range append([]reliable_udp.Cipher{reliable_udp.CipherNone}, ciphers...) {
+		b.Run(c.String(), func(b *testing.B) {
+			receiver, sender := newLoopbackPair(b)
+			cfg := reliable_udp.Config{WindowSize: 64, Cipher: c, Key: testKey(4)}
+			if err := reliable_udp.Configure(receiver, cfg); err != nil {
+				b.Fatalf("Configure failed: %v", err)
+			}
+
+			const size = 1000
+			b.SetBytes(size)
+			b.ResetTimer()
+			transfer(b, receiver, sender, cfg, b.N, size)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"fmt"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+func TestFastRetransmitOnNack(t *testing.T) {
+	for _, mode := range []reliable_udp.Mode{reliable_udp.ModeSelectiveRepeat, reliable_udp.ModeGoBackN} {
+		t.Run(mode.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			reliable_udp.SetDropRate(5)
+			defer reliable_udp.SetDropRate(0)
+
+			// A long RTO makes every timeout recovery visible in the run time
+			cfg := reliable_udp.Config{
+				Mode:           mode,
+				WindowSize:     32,
+				MinRTO:         200 * time.Millisecond,
+				FastRetransmit: true,
+			}
+			got := transfer(t, receiver, sender, cfg, 300, 100)
+			for i, msg := range got {
+				if want := fmt.Sprintf("%06d", i); msg[:6] != want {
+					t.Fatalf("Message %d starts with %q, want %q", i, msg[:6], want)
+				}
+			}
+
+			s := reliable_udp.GetConnStatistics(sender)
+			if s.FastRetransmits == 0 {
+				t.Error("FastRetransmits = 0, want losses recovered by NACK")
+			}
+			if s.FastRetransmits+s.TimeoutRetransmits != s.Retransmits {
+				t.Errorf("Fast %d + timeout %d != %d retransmits",
+					s.FastRetransmits, s.TimeoutRetransmits, s.Retransmits)
+			}
+		})
+	}
+}
+
+func TestNackOnlyWhenSenderAsks(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		flags uint16
+		nacks int
+	}{
+		{"without FlagNack", 0, 0},
+		{"with FlagNack", reliable_udp.FlagNack, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+
+			// Sequence 2 is missing, so 3 arrives ahead of a gap
+			for _, seq := range []int64{1, 3} {
+				flags := tc.flags
+				if seq == 1 {
+					flags |= reliable_udp.FlagResync
+				}
+				wire := reliable_udp.EncodePacket(reliable_udp.Header{
+					Type:           reliable_udp.PacketData,
+					Flags:          flags,
+					SequenceNumber: seq,
+					Timestamp:      time.Now(),
+				}, []byte("x"))
+				if _, err := sender.Write(wire); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+			}
+			receiver.SetReadDeadline(time.Now().Add(time.Second))
+			if _, _, err := reliable_udp.ReceiveReliable(receiver); err != nil {
+				t.Fatalf("ReceiveReliable failed: %v", err)
+			}
+			// Sequence 3 is read and held back until 2 arrives
+			receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			reliable_udp.ReceiveReliable(receiver)
+
+			nacks := 0
+			buf := make([]byte, 256)
+			for {
+				sender.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				n, err := sender.Read(buf)
+				if err != nil {
+					break
+				}
+				if h, _, err := reliable_udp.DecodePacket(buf[:n]); err == nil && h.Type == reliable_udp.PacketNack {
+					nacks++
+				}
+			}
+			if nacks != tc.nacks {
+				t.Errorf("%d NACKs, want %d", nacks, tc.nacks)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"fmt"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+func TestFECRecoversLoss(t *testing.T) {
+	for _, mode := range []reliable_udp.Mode{reliable_udp.ModeSelectiveRepeat, reliable_udp.ModeGoBackN} {
+		t.Run(mode.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			reliable_udp.SetDropRate(5)
+			defer reliable_udp.SetDropRate(0)
+
+			// A long RTO leaves time for parity to repair losses first
+			cfg := reliable_udp.Config{
+				Mode:       mode,
+				WindowSize: 32,
+				MinRTO:     200 * time.Millisecond,
+				FECGroup:   4,
+			}
+			got := transfer(t, receiver, sender, cfg, 300, 100)
+			for i, msg := range got {
+				if want := fmt.Sprintf("%06d", i); msg[:6] != want {
+					t.Fatalf("Message %d starts with %q, want %q", i, msg[:6], want)
+				}
+			}
+
+			s := reliable_udp.GetConnStatistics(sender)
+			if s.ParityPackets < 300/4 {
+				t.Errorf("ParityPackets = %d, want at least %d", s.ParityPackets, 300/4)
+			}
+			if s.FECOverhead <= 0 || s.FECOverhead > 0.5 {
+				t.Errorf("FECOverhead = %.2f, want about 1/4", s.FECOverhead)
+			}
+			if r := reliable_udp.GetConnStatistics(receiver); r.FECRecovered == 0 {
+				t.Error("FECRecovered = 0, want losses repaired from parity")
+			}
+		})
+	}
+}
+
+func TestConnFEC(t *testing.T) {
+	client, server := newConnPair(t, reliable_udp.Config{FECGroup: 8})
+	reliable_udp.SetDropRate(5)
+	defer reliable_udp.SetDropRate(0)
+
+	exchangeBothWays(t, client, server, 200)
+
+	recovered := client.Statistics().FECRecovered + server.Statistics().FECRecovered
+	if recovered == 0 {
+		t.Error("FECRecovered = 0 on both ends, want losses repaired from parity")
+	}
+}
+
+func BenchmarkFEC(b *testing.B) {
+	const size = 1000
+	for _, drop := range []float64{1, 5, 10} {
+		for _, group := range []int{0, 4, 8, 16} {
+			b.Run(fmt.Sprintf("drop=%v%%/group=%d", drop, group), func(b *testing.B) {
+				receiver, sender := newLoopbackPair(b)
+				reliable_udp.SetDropRate(drop)
+				defer reliable_udp.SetDropRate(0)
+
+				cfg := reliable_udp.Config{
+					WindowSize:  64,
+					MinRTO:      50 * time.Millisecond,
+					RetryPolicy: reliable_udp.RetryPolicy{MaxAttempts: 20},
+					FECGroup:    group,
+				}
+				b.SetBytes(size)
+				b.ResetTimer()
+				transfer(b, receiver, sender, cfg, b.N, size)
+				b.StopTimer()
+
+				s := reliable_udp.GetConnStatistics(sender)
+				r := reliable_udp.GetConnStatistics(receiver)
+				b.ReportMetric(float64(s.Retransmits)/float64(b.N), "retransmits/msg")
+				b.ReportMetric(float64(r.FECRecovered)/float64(b.N), "recovered/msg")
+				b.ReportMetric(s.FECOverhead*100, "overhead-%")
+			})
+		}
+	}
+}
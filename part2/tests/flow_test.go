@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"fmt"
+	"part2/reliable_udp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceiveWindowStallsSender(t *testing.T) {
+	const window, size, count = 1000, 200, 20
+	client, server := newConnPair(t, reliable_udp.Config{
+		WindowSize:    16,
+		MaxRTO:        50 * time.Millisecond,
+		ReceiveWindow: window,
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			msg := fmt.Sprintf("%02d", i) + strings.Repeat("x", size-2)
+			if err := client.Send([]byte(msg)); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- client.Flush()
+	}()
+
+	// Nobody reads, so the window closes and only probes get through
+	time.Sleep(300 * time.Millisecond)
+	s := client.Statistics()
+	if s.WindowStalled <= 0 {
+		t.Errorf("WindowStalled = %v, want > 0", s.WindowStalled)
+	}
+	if s.ZeroWindowProbes == 0 {
+		t.Error("No zero-window probes were sent")
+	}
+	if max := window/size + s.ZeroWindowProbes; s.SentPackets > max {
+		t.Errorf("Sent %d packets into a window of %d plus %d probes",
+			s.SentPackets, window/size, s.ZeroWindowProbes)
+	}
+
+	for i := 0; i < count; i++ {
+		msg, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive %d failed: %v", i, err)
+		}
+		if want := fmt.Sprintf("%02d", i); string(msg[:2]) != want {
+			t.Fatalf("Message %d starts with %q, want %q", i, msg[:2], want)
+		}
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sender did not recover once the window opened")
+	}
+}
@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+func TestFragmentedMessages(t *testing.T) {
+	sizes := []int{
+		reliable_udp.MaxPacketSize,
+		reliable_udp.MaxPacketSize + 1,
+		64 * 1024,
+		1 << 20,
+	}
+
+	senders := map[string]func(t *testing.T, sender *net.UDPConn, msg []byte){
+		"SendReliable": func(t *testing.T, sender *net.UDPConn, msg []byte) {
+			if _, err := reliable_udp.SendReliable(sender, string(msg)); err != nil {
+				t.Fatalf("SendReliable failed: %v", err)
+			}
+		},
+		"WindowSender": func(t *testing.T, sender *net.UDPConn, msg []byte) {
+			ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{WindowSize: 64})
+			if err := ws.Send(msg); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+			if err := ws.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+		},
+	}
+
+	for name, send := range senders {
+		t.Run(name, func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+
+			for _, size := range sizes {
+				msg := make([]byte, size)
+				rand.Read(msg)
+
+				done := make(chan []byte, 1)
+				go func() {
+					receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+					data, _, err := reliable_udp.ReceiveReliable(receiver)
+					if err != nil {
+						t.Errorf("ReceiveReliable failed: %v", err)
+					}
+					done <- data
+				}()
+
+				send(t, sender, msg)
+				if got := <-done; !bytes.Equal(got, msg) {
+					t.Fatalf("Size %d: received %d bytes that differ from the message", size, len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	_, sender := newLoopbackPair(t)
+	msg := make([]byte, reliable_udp.MaxMessageSize+1)
+	if _, err := reliable_udp.SendReliable(sender, string(msg)); err == nil {
+		t.Error("SendReliable accepted a message over MaxMessageSize")
+	}
+}
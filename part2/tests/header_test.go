@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	payload := []byte("hello reliable udp")
+	sent := reliable_udp.Header{
+		Type:           reliable_udp.PacketData,
+		Flags:          0x0102,
+		SequenceNumber: 42,
+		Timestamp:      time.Now(),
+	}
+
+	wire := reliable_udp.EncodePacket(sent, payload)
+	if len(wire) != reliable_udp.HeaderSize+len(payload) {
+		t.Fatalf("Encoded length %d, want %d", len(wire), reliable_udp.HeaderSize+len(payload))
+	}
+
+	got, data, err := reliable_udp.DecodePacket(wire)
+	if err != nil {
+		t.Fatalf("DecodePacket failed: %v", err)
+	}
+	if got.Version != reliable_udp.HeaderVersion {
+		t.Errorf("Version = %d, want %d", got.Version, reliable_udp.HeaderVersion)
+	}
+	if got.Type != sent.Type || got.Flags != sent.Flags || got.SequenceNumber != sent.SequenceNumber {
+		t.Errorf("Header mismatch: got %+v, sent %+v", got, sent)
+	}
+	if !got.Timestamp.Equal(sent.Timestamp) {
+		t.Errorf("Timestamp = %v, want %v", got.Timestamp, sent.Timestamp)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("Payload = %q, want %q", data, payload)
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	wire := reliable_udp.EncodePacket(reliable_udp.Header{Type: reliable_udp.PacketData}, []byte("abc"))
+
+	tests := []struct {
+		name string
+		buf  []byte
+		want error
+	}{
+		{"short", wire[:reliable_udp.HeaderSize-1], reliable_udp.ErrShortPacket},
+		{"magic", append([]byte{0, 0}, wire[2:]...), reliable_udp.ErrBadMagic},
+		{"version", append(append([]byte{}, wire[:2]...), append([]byte{99}, wire[3:]...)...), reliable_udp.ErrUnsupportedVersion},
+		{"truncated payload", wire[:len(wire)-1], reliable_udp.ErrLengthMismatch},
+		{"flipped bit", append(append([]byte{}, wire[:len(wire)-1]...), wire[len(wire)-1]^0x10), reliable_udp.ErrChecksumMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := reliable_udp.DecodePacket(tt.buf); !errors.Is(err, tt.want) {
+				t.Errorf("DecodePacket error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
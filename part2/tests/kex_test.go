@@ -0,0 +1,267 @@
+package tests
+
+import (
+	"compress/flate"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"part2/reliable_udp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newIdentity(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	return pub, priv
+}
+
+// exchangeBothWays sends count messages each way and checks they arrive
+// in order
+func exchangeBothWays(t *testing.T, client, server *reliable_udp.Conn, count int) {
+	t.Helper()
+
+	for _, dir := range []struct {
+		name     string
+		from, to *reliable_udp.Conn
+	}{{"client", client, server}, {"server", server, client}} {
+		errs := make(chan error, 1)
+		go func() {
+			for i := 0; i < count; i++ {
+				if err := dir.from.Send([]byte(fmt.Sprintf("%s-%d", dir.name, i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		for i := 0; i < count; i++ {
+			data, err := dir.to.Receive()
+			if err != nil {
+				t.Fatalf("Receive from %s %d failed: %v", dir.name, i, err)
+			}
+			if want := fmt.Sprintf("%s-%d", dir.name, i); string(data) != want {
+				t.Fatalf("Message %d = %q, want %q", i, data, want)
+			}
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("Send from %s failed: %v", dir.name, err)
+		}
+	}
+}
+
+func TestKeyExchangeWithPSK(t *testing.T) {
+	for _, c := range ciphers {
+		t.Run(c.String(), func(t *testing.T) {
+			client, server := newConnPair(t, reliable_udp.Config{
+				Cipher:       c,
+				Key:          testKey(5),
+				KeyExchange:  true,
+				RekeyPackets: 16,
+			})
+			reliable_udp.SetDropRate(5)
+			defer reliable_udp.SetDropRate(0)
+
+			exchangeBothWays(t, client, server, 100)
+
+			for _, conn := range []*reliable_udp.Conn{client, server} {
+				st := conn.Statistics()
+				if st.KeyUpdates == 0 {
+					t.Error("Session keys were never updated")
+				}
+				if st.AuthFailures != 0 || st.ReplayedPackets != 0 {
+					t.Errorf("AuthFailures = %d, ReplayedPackets = %d, want 0",
+						st.AuthFailures, st.ReplayedPackets)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyExchangeWithIdentity(t *testing.T) {
+	clientPub, clientPriv := newIdentity(t)
+	serverPub, serverPriv := newIdentity(t)
+	strangerPub, strangerPriv := newIdentity(t)
+
+	l, err := reliable_udp.Listen("127.0.0.1:0", reliable_udp.Config{
+		Cipher:       reliable_udp.CipherChaCha20Poly1305,
+		KeyExchange:  true,
+		Identity:     serverPriv,
+		TrustedPeers: []ed25519.PublicKey{clientPub},
+	})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	client, err := reliable_udp.Dial(l.Addr().String(), reliable_udp.Config{
+		Cipher:       reliable_udp.CipherChaCha20Poly1305,
+		KeyExchange:  true,
+		Identity:     clientPriv,
+		TrustedPeers: []ed25519.PublicKey{serverPub},
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+	exchangeBothWays(t, client, server, 10)
+
+	// The listener ignores identities it does not trust
+	_, err = reliable_udp.Dial(l.Addr().String(), reliable_udp.Config{
+		Cipher:           reliable_udp.CipherChaCha20Poly1305,
+		KeyExchange:      true,
+		Identity:         strangerPriv,
+		TrustedPeers:     []ed25519.PublicKey{serverPub, strangerPub},
+		HandshakeTimeout: 200 * time.Millisecond,
+	})
+	if !errors.Is(err, reliable_udp.ErrHandshakeTimeout) {
+		t.Fatalf("Dial with untrusted identity error = %v, want %v", err, reliable_udp.ErrHandshakeTimeout)
+	}
+}
+
+// newTamperRelay forwards datagrams between one client and target, passing
+// those from the client through tamper
+func newTamperRelay(t *testing.T, target *net.UDPAddr, tamper func([]byte) []byte) *net.UDPAddr {
+	t.Helper()
+
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	back, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			client.Store(addr)
+			back.Write(tamper(buf[:n]))
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := back.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			if addr := client.Load(); addr != nil {
+				front.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+	return front.LocalAddr().(*net.UDPAddr)
+}
+
+func TestKeyExchangeSignsCompressorOffer(t *testing.T) {
+	clientPub, clientPriv := newIdentity(t)
+	serverPub, serverPriv := newIdentity(t)
+	compressors := []reliable_udp.Compressor{reliable_udp.NewFlateCompressor(flate.BestSpeed)}
+
+	l, err := reliable_udp.Listen("127.0.0.1:0", reliable_udp.Config{
+		Cipher:       reliable_udp.CipherChaCha20Poly1305,
+		KeyExchange:  true,
+		Identity:     serverPriv,
+		TrustedPeers: []ed25519.PublicKey{clientPub},
+		Compressors:  compressors,
+	})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// Strip the compressor offer that follows the X25519 key, Ed25519 key
+	// and signature of the SYN, downgrading to no compression
+	const helloSize = 32 + ed25519.PublicKeySize + ed25519.SignatureSize
+	strip := func(b []byte) []byte {
+		h, payload, err := reliable_udp.DecodePacket(b)
+		if err != nil || h.Type != reliable_udp.PacketSyn || len(payload) <= helloSize {
+			return b
+		}
+		return reliable_udp.EncodePacket(h, payload[:helloSize])
+	}
+
+	cfg := reliable_udp.Config{
+		Cipher:           reliable_udp.CipherChaCha20Poly1305,
+		KeyExchange:      true,
+		Identity:         clientPriv,
+		TrustedPeers:     []ed25519.PublicKey{serverPub},
+		HandshakeTimeout: 300 * time.Millisecond,
+	}
+	// Without an offer there is nothing to strip
+	relay := newTamperRelay(t, l.Addr().(*net.UDPAddr), strip)
+	client, err := reliable_udp.Dial(relay.String(), cfg)
+	if err != nil {
+		t.Fatalf("Dial without compressors failed: %v", err)
+	}
+	client.Close()
+
+	cfg.Compressors = compressors
+	relay = newTamperRelay(t, l.Addr().(*net.UDPAddr), strip)
+	if _, err = reliable_udp.Dial(relay.String(), cfg); !errors.Is(err, reliable_udp.ErrHandshakeTimeout) {
+		t.Fatalf("Dial with a stripped offer error = %v, want %v", err, reliable_udp.ErrHandshakeTimeout)
+	}
+}
+
+func TestKeyExchangeConfig(t *testing.T) {
+	_, priv := newIdentity(t)
+	for _, tc := range []struct {
+		name string
+		cfg  reliable_udp.Config
+	}{
+		{"no cipher", reliable_udp.Config{KeyExchange: true, Key: testKey(1)}},
+		{"unauthenticated", reliable_udp.Config{KeyExchange: true, Cipher: reliable_udp.CipherAESGCM}},
+		{"no trusted peers", reliable_udp.Config{KeyExchange: true, Cipher: reliable_udp.CipherAESGCM, Identity: priv}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if l, err := reliable_udp.Listen("127.0.0.1:0", tc.cfg); err == nil {
+				l.Close()
+				t.Error("Listen succeeded")
+			}
+		})
+	}
+
+	receiver, _ := newLoopbackPair(t)
+	err := reliable_udp.Configure(receiver, reliable_udp.Config{
+		KeyExchange: true,
+		Cipher:      reliable_udp.CipherAESGCM,
+		Key:         testKey(1),
+	})
+	if err == nil {
+		t.Error("Configure accepted key exchange on a plain socket")
+	}
+}
@@ -0,0 +1,288 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"part2/reliable_udp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loopbackPMTU is what discovery should find on loopback: the largest IPv4
+// UDP datagram plus its IP and UDP headers
+const loopbackPMTU = 65507 + 28
+
+func skipUnlessLinux(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("path MTU discovery needs Linux")
+	}
+}
+
+// waitFor polls cond until it holds or the timeout passes
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newSizeLimitRelay forwards datagrams between one client and target,
+// dropping those larger than the returned limit, like a path with a smaller
+// MTU that does not report it
+func newSizeLimitRelay(t *testing.T, target *net.UDPAddr, limit int64) (*net.UDPAddr, *atomic.Int64) {
+	t.Helper()
+
+	max := &atomic.Int64{}
+	max.Store(limit)
+	relay := newFilterRelay(t, target, func(n int) bool { return int64(n) <= max.Load() })
+	return relay, max
+}
+
+// newFilterRelay forwards datagrams between one client and target in both
+// directions, dropping those of n bytes for which pass returns false
+func newFilterRelay(t *testing.T, target *net.UDPAddr, pass func(n int) bool) *net.UDPAddr {
+	t.Helper()
+
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	back, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			client.Store(addr)
+			if pass(n) {
+				back.Write(buf[:n])
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := back.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			if addr := client.Load(); addr != nil && pass(n) {
+				front.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+	return front.LocalAddr().(*net.UDPAddr)
+}
+
+func TestPathMTUDiscoveryConn(t *testing.T) {
+	skipUnlessLinux(t)
+	client, server := newConnPair(t, reliable_udp.Config{PathMTUDiscovery: true})
+
+	waitFor(t, 5*time.Second, "path MTU", func() bool {
+		return client.Statistics().PathMTU > loopbackPMTU-16
+	})
+	st := client.Statistics()
+	if st.PathMTU > loopbackPMTU {
+		t.Errorf("PathMTU = %d, want at most %d", st.PathMTU, loopbackPMTU)
+	}
+	if st.PacketSize <= reliable_udp.MaxPacketSize {
+		t.Errorf("PacketSize = %d, want more than %d", st.PacketSize, reliable_udp.MaxPacketSize)
+	}
+
+	msg := bytes.Repeat([]byte("0123456789"), 20000)
+	if err := client.Send(msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Received %d bytes, want the %d sent", len(got), len(msg))
+	}
+	if sent := client.Statistics().SentPackets - st.SentPackets; sent > 4 {
+		t.Errorf("Message took %d packets, want at most 4", sent)
+	}
+}
+
+func TestPathMTUDiscoveryWindowSender(t *testing.T) {
+	skipUnlessLinux(t)
+	receiver, sender := newLoopbackPair(t)
+
+	msgs := make(chan []byte, 1)
+	go func() {
+		for {
+			data, _, err := reliable_udp.ReceiveReliable(receiver)
+			if err == nil {
+				msgs <- data
+			} else if strings.HasPrefix(err.Error(), "read error") {
+				return
+			}
+		}
+	}()
+
+	ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{PathMTUDiscovery: true})
+	defer ws.Close()
+	waitFor(t, 5*time.Second, "path MTU", func() bool {
+		return reliable_udp.GetConnStatistics(sender).PathMTU > loopbackPMTU-16
+	})
+
+	msg := bytes.Repeat([]byte("x"), 50000)
+	if err := ws.Send(msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	select {
+	case got := <-msgs:
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("Received %d bytes, want the %d sent", len(got), len(msg))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+}
+
+func TestPathMTUBlackHole(t *testing.T) {
+	skipUnlessLinux(t)
+	cfg := reliable_udp.Config{
+		PathMTUDiscovery: true,
+		MinRTO:           20 * time.Millisecond,
+		// The message sent into the black hole never arrives
+		RetryPolicy: reliable_udp.RetryPolicy{Backoff: reliable_udp.BackoffConstant, MaxAttempts: 1000},
+		Linger:      100 * time.Millisecond,
+	}
+	l, err := reliable_udp.Listen("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	relay, limit := newSizeLimitRelay(t, l.Addr().(*net.UDPAddr), 9000)
+
+	client, err := reliable_udp.Dial(relay.String(), cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+
+	// The relay carries datagrams of up to 9000 bytes
+	waitFor(t, 10*time.Second, "path MTU of the relay", func() bool {
+		return client.Statistics().PathMTU > 9000+28-16
+	})
+	if mtu := client.Statistics().PathMTU; mtu > 9000+28 {
+		t.Fatalf("PathMTU = %d, want at most %d", mtu, 9000+28)
+	}
+
+	// The path shrinks without telling anyone
+	limit.Store(4000)
+	if err := client.Send(make([]byte, 8000)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	waitFor(t, 10*time.Second, "black hole detection", func() bool {
+		return client.Statistics().MTUBlackHoles > 0
+	})
+	waitFor(t, 10*time.Second, "path MTU after the black hole", func() bool {
+		mtu := client.Statistics().PathMTU
+		return mtu > 4000+28-16 && mtu <= 4000+28
+	})
+}
+
+func TestPathMTUSurvivesProbeLoss(t *testing.T) {
+	skipUnlessLinux(t)
+	cfg := reliable_udp.Config{
+		PathMTUDiscovery: true,
+		MinRTO:           20 * time.Millisecond,
+		RetryPolicy:      reliable_udp.RetryPolicy{Backoff: reliable_udp.BackoffConstant, MaxAttempts: 1000},
+		Linger:           100 * time.Millisecond,
+	}
+	l, err := reliable_udp.Listen("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	// Datagrams of up to 9000 bytes get through, except for a few losses
+	// armed below: two of the data packet, then three probes
+	var dataLoss, probeLoss atomic.Int64
+	relay := newFilterRelay(t, l.Addr().(*net.UDPAddr), func(n int) bool {
+		switch {
+		case n > 9000:
+			return false
+		case n > 8500:
+			return probeLoss.Add(-1) < 0
+		case n > 4000:
+			return dataLoss.Add(-1) < 0
+		}
+		return true
+	})
+
+	client, err := reliable_udp.Dial(relay.String(), cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+
+	waitFor(t, 10*time.Second, "path MTU of the relay", func() bool {
+		return client.Statistics().PathMTU > 9000+28-16
+	})
+	// Let the search finish, so that its probes are not the ones lost
+	probes := client.Statistics().MTUProbes
+	waitFor(t, 10*time.Second, "the end of the search", func() bool {
+		time.Sleep(300 * time.Millisecond)
+		n := client.Statistics().MTUProbes
+		done := n == probes
+		probes = n
+		return done
+	})
+
+	dataLoss.Store(2)
+	probeLoss.Store(3)
+	if err := client.Send(make([]byte, 8000)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := server.Receive(); err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	waitFor(t, 10*time.Second, "the lost probes", func() bool {
+		return probeLoss.Load() < 0
+	})
+
+	s := client.Statistics()
+	if s.MTUBlackHoles != 0 {
+		t.Errorf("MTUBlackHoles = %d after losing three probes, want 0", s.MTUBlackHoles)
+	}
+	if s.PathMTU <= 9000+28-16 {
+		t.Errorf("PathMTU = %d, want the confirmed size kept", s.PathMTU)
+	}
+}
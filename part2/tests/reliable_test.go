@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"net"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+// newLoopbackPair returns a receiver socket and a sender socket connected to it
+func newLoopbackPair(t testing.TB) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { receiver.Close() })
+
+	sender, err := net.DialUDP("udp", nil, receiver.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { sender.Close() })
+
+	return receiver, sender
+}
+
+func TestSendReceiveReliable(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			data, _, err := reliable_udp.ReceiveReliable(receiver)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(data)
+		}
+	}()
+
+	for _, msg := range []string{"one", "two", "three"} {
+		if _, err := reliable_udp.SendReliable(sender, msg); err != nil {
+			t.Fatalf("SendReliable(%q) failed: %v", msg, err)
+		}
+		if got := <-received; got != msg {
+			t.Errorf("Received %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestReceiveReliableSuppressesDuplicates(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+
+	packet := reliable_udp.EncodePacket(reliable_udp.Header{
+		Type:           reliable_udp.PacketData,
+		Flags:          reliable_udp.FlagResync,
+		SequenceNumber: 7,
+		Timestamp:      time.Now(),
+	}, []byte("once"))
+	next := reliable_udp.EncodePacket(reliable_udp.Header{
+		Type:           reliable_udp.PacketData,
+		Flags:          reliable_udp.FlagResync,
+		SequenceNumber: 8,
+		Timestamp:      time.Now(),
+	}, []byte("twice"))
+
+	// A retransmission of sequence 7 arrives before sequence 8
+	for _, wire := range [][]byte{packet, packet, next} {
+		if _, err := sender.Write(wire); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []string{"once", "twice"} {
+		data, _, err := reliable_udp.ReceiveReliable(receiver)
+		if err != nil {
+			t.Fatalf("ReceiveReliable failed: %v", err)
+		}
+		if string(data) != want {
+			t.Errorf("Received %q, want %q", data, want)
+		}
+	}
+
+	// Every copy, including the duplicate, must have been acknowledged
+	buf := make([]byte, 64)
+	sender.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []int64{7, 7, 8} {
+		n, err := sender.Read(buf)
+		if err != nil {
+			t.Fatalf("Reading ACK failed: %v", err)
+		}
+		header, _, err := reliable_udp.DecodePacket(buf[:n])
+		if err != nil {
+			t.Fatalf("Bad ACK: %v", err)
+		}
+		if header.Type != reliable_udp.PacketAck || header.SequenceNumber != want {
+			t.Errorf("Got %v %d, want ACK %d", header.Type, header.SequenceNumber, want)
+		}
+	}
+}
+
+func TestReceiveReliableResyncsRestartedSender(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+
+	// The sender restarts far below where it was; a late retransmission
+	// of its old resync packet is still a duplicate
+	for _, p := range []struct {
+		seq  int64
+		data string
+	}{{5000, "before"}, {5000, "again"}, {7, "after"}} {
+		wire := reliable_udp.EncodePacket(reliable_udp.Header{
+			Type:           reliable_udp.PacketData,
+			Flags:          reliable_udp.FlagResync,
+			SequenceNumber: p.seq,
+			Timestamp:      time.Now(),
+		}, []byte(p.data))
+		if _, err := sender.Write(wire); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []string{"before", "after"} {
+		data, _, err := reliable_udp.ReceiveReliable(receiver)
+		if err != nil {
+			t.Fatalf("ReceiveReliable failed: %v", err)
+		}
+		if string(data) != want {
+			t.Errorf("Received %q, want %q", data, want)
+		}
+	}
+}
+
+func TestReceiveReliableAfterSenderRelease(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			data, _, err := reliable_udp.ReceiveReliable(receiver)
+			if err != nil {
+				return
+			}
+			received <- string(data)
+		}
+	}()
+
+	for _, msg := range []string{"before", "after"} {
+		if _, err := reliable_udp.SendReliable(sender, msg); err != nil {
+			t.Fatalf("SendReliable %q failed: %v", msg, err)
+		}
+		select {
+		case got := <-received:
+			if got != msg {
+				t.Fatalf("Received %q, want %q", got, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Never received %q", msg)
+		}
+		reliable_udp.Release(sender)
+	}
+}
+
+func TestReceiveReliableForgetsIdleSenders(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+	if err := reliable_udp.Configure(receiver, reliable_udp.Config{IdleTimeout: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			data, _, err := reliable_udp.ReceiveReliable(receiver)
+			if err != nil {
+				return
+			}
+			received <- string(data)
+		}
+	}()
+
+	ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{})
+	defer ws.Close()
+	for _, msg := range []string{"before", "after"} {
+		if err := ws.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %q failed: %v", msg, err)
+		}
+		if err := ws.Flush(); err != nil {
+			t.Fatalf("Flush %q failed: %v", msg, err)
+		}
+		select {
+		case got := <-received:
+			if got != msg {
+				t.Fatalf("Received %q, want %q", got, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Never received %q", msg)
+		}
+
+		// The receiver forgets the sender, which must resync
+		time.Sleep(300 * time.Millisecond)
+	}
+}
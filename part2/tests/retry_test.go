@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	base := 10 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		policy  reliable_udp.RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"exponential first", reliable_udp.RetryPolicy{Multiplier: 2}, 0, 10 * time.Millisecond},
+		{"exponential third", reliable_udp.RetryPolicy{Multiplier: 2}, 2, 40 * time.Millisecond},
+		{"exponential capped", reliable_udp.RetryPolicy{Multiplier: 2, MaxDelay: 25 * time.Millisecond}, 2, 25 * time.Millisecond},
+		{"linear", reliable_udp.RetryPolicy{Backoff: reliable_udp.BackoffLinear, Multiplier: 1}, 3, 40 * time.Millisecond},
+		{"constant", reliable_udp.RetryPolicy{Backoff: reliable_udp.BackoffConstant}, 4, 10 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Delay(tt.attempt, base); got != tt.want {
+				t.Errorf("Delay(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyJitterBounds(t *testing.T) {
+	base := 10 * time.Millisecond
+	full := reliable_udp.RetryPolicy{Backoff: reliable_udp.BackoffConstant, Jitter: reliable_udp.JitterFull}
+	equal := reliable_udp.RetryPolicy{Backoff: reliable_udp.BackoffConstant, Jitter: reliable_udp.JitterEqual}
+
+	for i := 0; i < 1000; i++ {
+		if d := full.Delay(0, base); d <= 0 || d > base {
+			t.Fatalf("Full jitter delay %v outside (0, %v]", d, base)
+		}
+		if d := equal.Delay(0, base); d < base/2 || d > base {
+			t.Fatalf("Equal jitter delay %v outside [%v, %v]", d, base/2, base)
+		}
+	}
+}
+
+func TestRetryPolicyBudget(t *testing.T) {
+	attempts := reliable_udp.RetryPolicy{MaxAttempts: 3}
+	if attempts.Exhausted(2, time.Hour) {
+		t.Error("Attempt budget exhausted after 2 of 3 transmissions")
+	}
+	if !attempts.Exhausted(3, 0) {
+		t.Error("Attempt budget not exhausted after 3 of 3 transmissions")
+	}
+
+	elapsed := reliable_udp.RetryPolicy{MaxElapsed: 50 * time.Millisecond}
+	if elapsed.Exhausted(100, 49*time.Millisecond) {
+		t.Error("Elapsed budget exhausted early")
+	}
+	if !elapsed.Exhausted(1, 50*time.Millisecond) {
+		t.Error("Elapsed budget not exhausted after 50ms")
+	}
+
+	def := reliable_udp.DefaultRetryPolicy()
+	if def.Exhausted(reliable_udp.MaxRetries, 10*time.Millisecond) {
+		t.Error("Default policy gave up after 10ms")
+	}
+	if !def.Exhausted(reliable_udp.MaxRetries, 5*reliable_udp.RetryTimeout) {
+		t.Error("Default policy not exhausted after MaxRetries transmissions and 500ms")
+	}
+}
+
+func TestSendReliableSurvivesReceiverStall(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+
+	// A few exchanges bring the RTO down to the loopback RTT, then the
+	// receiver stops reading for a while, as if descheduled
+	const warmup = 5
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i <= warmup; i++ {
+			if i == warmup {
+				time.Sleep(300 * time.Millisecond)
+			}
+			if _, _, err := reliable_udp.ReceiveReliable(receiver); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < warmup; i++ {
+		if _, err := reliable_udp.SendReliable(sender, "warmup"); err != nil {
+			t.Fatalf("SendReliable %d failed: %v", i, err)
+		}
+	}
+	if _, err := reliable_udp.SendReliable(sender, "late"); err != nil {
+		t.Fatalf("SendReliable failed across a 300ms receiver stall: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ReceiveReliable failed: %v", err)
+	}
+}
+
+func TestSendReliableWithPolicyGivesUp(t *testing.T) {
+	// Nobody reads from the receiver socket, so every attempt times out
+	_, sender := newLoopbackPair(t)
+	reliable_udp.Configure(sender, reliable_udp.Config{MinRTO: time.Millisecond, MaxRTO: 5 * time.Millisecond})
+
+	policy := reliable_udp.RetryPolicy{Backoff: reliable_udp.BackoffConstant, MaxAttempts: 3}
+	start := time.Now()
+	if _, err := reliable_udp.SendReliableWithPolicy(sender, "lost", policy); err == nil {
+		t.Fatal("SendReliableWithPolicy succeeded without a receiver")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Gave up after %v, want about 3 timeouts", elapsed)
+	}
+}
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"fmt"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+func TestGoBackNWithSACK(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+	reliable_udp.SetDropRate(10)
+	defer reliable_udp.SetDropRate(0)
+
+	const count = 300
+	var got []string
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+		got, recvErr = receiveAll(count, func() ([]byte, error) {
+			data, _, err := reliable_udp.ReceiveReliable(receiver)
+			return data, err
+		})
+	}()
+
+	ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{
+		Mode:       reliable_udp.ModeGoBackN,
+		WindowSize: 32,
+		SACK:       true,
+	})
+	for i := 0; i < count; i++ {
+		if err := ws.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if err := ws.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	<-done
+	if recvErr != nil {
+		t.Fatalf("Receive failed: %v", recvErr)
+	}
+	for i, msg := range got {
+		if want := fmt.Sprintf("msg-%d", i); msg != want {
+			t.Fatalf("Message %d = %q, want %q", i, msg, want)
+		}
+	}
+
+	s := reliable_udp.GetConnStatistics(sender)
+	if s.SackAvoided == 0 {
+		t.Error("SackAvoided = 0, want SACK to save retransmissions")
+	}
+}
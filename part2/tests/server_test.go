@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"part2/reliable_udp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dialServer returns a socket connected to the server
+func dialServer(t *testing.T, s *reliable_udp.Server) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.DialUDP("udp", nil, s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServerHandlerSeparatesPeers(t *testing.T) {
+	const peers, count = 5, 50
+
+	var mu sync.Mutex
+	got := make(map[string][]string)
+	all := make(chan struct{}, peers*count)
+	s, err := reliable_udp.NewServer("127.0.0.1:0", reliable_udp.Config{}, func(sess *reliable_udp.Session, msg []byte) {
+		mu.Lock()
+		key := sess.RemoteAddr().String()
+		got[key] = append(got[key], string(msg))
+		mu.Unlock()
+		all <- struct{}{}
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer s.Close()
+	reliable_udp.SetDropRate(10)
+	defer reliable_udp.SetDropRate(0)
+
+	senders := make([]*net.UDPConn, peers)
+	var wg sync.WaitGroup
+	for p := range senders {
+		senders[p] = dialServer(t, s)
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			ws := reliable_udp.NewWindowSender(senders[p], reliable_udp.Config{WindowSize: 8})
+			for i := 0; i < count; i++ {
+				if err := ws.Send([]byte(fmt.Sprintf("peer%d-%d", p, i))); err != nil {
+					t.Errorf("Peer %d send %d failed: %v", p, i, err)
+					break
+				}
+			}
+			if err := ws.Close(); err != nil {
+				t.Errorf("Peer %d close failed: %v", p, err)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	for i := 0; i < peers*count; i++ {
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Received only %d of %d messages", i, peers*count)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for p, sender := range senders {
+		msgs := got[sender.LocalAddr().String()]
+		if len(msgs) != count {
+			t.Errorf("Peer %d: %d messages, want %d", p, len(msgs), count)
+			continue
+		}
+		for i, msg := range msgs {
+			if want := fmt.Sprintf("peer%d-%d", p, i); msg != want {
+				t.Errorf("Peer %d message %d = %q, want %q", p, i, msg, want)
+				break
+			}
+		}
+	}
+
+	sessions := s.Sessions()
+	if len(sessions) != peers {
+		t.Fatalf("%d sessions, want %d", len(sessions), peers)
+	}
+	for _, sess := range sessions {
+		if st := sess.Statistics(); st.RecvPackets < count {
+			t.Errorf("Session %v: RecvPackets = %d, want at least %d",
+				sess.RemoteAddr(), st.RecvPackets, count)
+		}
+	}
+}
+
+func TestServerAcceptAndReap(t *testing.T) {
+	s, err := reliable_udp.NewServer("127.0.0.1:0", reliable_udp.Config{IdleTimeout: 100 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer s.Close()
+
+	sender := dialServer(t, s)
+	if _, err := reliable_udp.SendReliable(sender, "hello"); err != nil {
+		t.Fatalf("SendReliable failed: %v", err)
+	}
+
+	sess, err := s.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if sess.RemoteAddr().String() != sender.LocalAddr().String() {
+		t.Errorf("Session for %v, want %v", sess.RemoteAddr(), sender.LocalAddr())
+	}
+	msg, err := sess.Receive()
+	if err != nil || string(msg) != "hello" {
+		t.Fatalf("Receive = %q, %v; want %q", msg, err, "hello")
+	}
+
+	// The idle session is reaped and Receive reports why
+	if _, err := sess.Receive(); !errors.Is(err, reliable_udp.ErrIdleTimeout) {
+		t.Fatalf("Receive on idle session = %v, want %v", err, reliable_udp.ErrIdleTimeout)
+	}
+	if n := len(s.Sessions()); n != 0 {
+		t.Errorf("%d sessions after reaping, want 0", n)
+	}
+}
+
+func TestServerBoundsSessions(t *testing.T) {
+	s, err := reliable_udp.NewServer("127.0.0.1:0", reliable_udp.Config{MaxSessions: 1}, nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer s.Close()
+
+	first := dialServer(t, s)
+	if _, err := reliable_udp.SendReliable(first, "hello"); err != nil {
+		t.Fatalf("SendReliable failed: %v", err)
+	}
+
+	// No session is created for a second peer, so nothing ACKs it
+	second := dialServer(t, s)
+	reliable_udp.Configure(second, reliable_udp.Config{MinRTO: 20 * time.Millisecond, MaxRTO: 20 * time.Millisecond})
+	policy := reliable_udp.RetryPolicy{Backoff: reliable_udp.BackoffConstant, MaxAttempts: 3}
+	if _, err := reliable_udp.SendReliableWithPolicy(second, "hello", policy); err == nil {
+		t.Error("SendReliableWithPolicy succeeded beyond MaxSessions")
+	}
+	if n := len(s.Sessions()); n != 1 {
+		t.Errorf("%d sessions, want 1", n)
+	}
+
+	// Closing the session makes room for the second peer
+	sess, err := s.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	sess.Close()
+	if _, err := reliable_udp.SendReliable(second, "again"); err != nil {
+		t.Fatalf("SendReliable after closing the first session failed: %v", err)
+	}
+}
+
+func TestServerResumesAfterReap(t *testing.T) {
+	for _, mode := range []reliable_udp.Mode{reliable_udp.ModeSelectiveRepeat, reliable_udp.ModeGoBackN} {
+		t.Run(mode.String(), func(t *testing.T) {
+			got := make(chan string, 10)
+			cfg := reliable_udp.Config{IdleTimeout: 200 * time.Millisecond}
+			s, err := reliable_udp.NewServer("127.0.0.1:0", cfg, func(sess *reliable_udp.Session, msg []byte) {
+				got <- string(msg)
+			})
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+			defer s.Close()
+
+			ws := reliable_udp.NewWindowSender(dialServer(t, s), reliable_udp.Config{Mode: mode})
+			defer ws.Close()
+
+			for _, msg := range []string{"before", "after"} {
+				if err := ws.Send([]byte(msg)); err != nil {
+					t.Fatalf("Send %q failed: %v", msg, err)
+				}
+				if err := ws.Flush(); err != nil {
+					t.Fatalf("Flush %q failed: %v", msg, err)
+				}
+				select {
+				case m := <-got:
+					if m != msg {
+						t.Fatalf("Handler got %q, want %q", m, msg)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Handler never got %q", msg)
+				}
+
+				// Let the server reap the session before the next message
+				time.Sleep(500 * time.Millisecond)
+			}
+		})
+	}
+}
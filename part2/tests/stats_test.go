@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"net"
+	"part2/reliable_udp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// exchange sends count messages of size bytes from sender to receiver
+func exchange(t *testing.T, receiver, sender *net.UDPConn, count, size int) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+		receiveAll(count, func() ([]byte, error) {
+			data, _, err := reliable_udp.ReceiveReliable(receiver)
+			return data, err
+		})
+	}()
+
+	msg := strings.Repeat("x", size)
+	for i := 0; i < count; i++ {
+		if _, err := reliable_udp.SendReliable(sender, msg); err != nil {
+			t.Errorf("Send %d failed: %v", i, err)
+			break
+		}
+	}
+	<-done
+}
+
+func TestConnStatisticsAreIsolated(t *testing.T) {
+	receiverA, senderA := newLoopbackPair(t)
+	receiverB, senderB := newLoopbackPair(t)
+	before := reliable_udp.GetStatistics()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); exchange(t, receiverA, senderA, 10, 100) }()
+	go func() { defer wg.Done(); exchange(t, receiverB, senderB, 25, 200) }()
+	wg.Wait()
+
+	for _, tc := range []struct {
+		name   string
+		sender *net.UDPConn
+		count  int
+		size   int
+	}{
+		{"a", senderA, 10, 100},
+		{"b", senderB, 25, 200},
+	} {
+		s := reliable_udp.GetConnStatistics(tc.sender)
+		if s.SentPackets != tc.count {
+			t.Errorf("%s: SentPackets = %d, want %d", tc.name, s.SentPackets, tc.count)
+		}
+		if want := int64(tc.count * tc.size); s.BytesAcked != want {
+			t.Errorf("%s: BytesAcked = %d, want %d", tc.name, s.BytesAcked, want)
+		}
+		if s.BytesSent < s.BytesAcked {
+			t.Errorf("%s: BytesSent %d < BytesAcked %d", tc.name, s.BytesSent, s.BytesAcked)
+		}
+		if s.MinRTT <= 0 || s.MinRTT > s.AvgRTT || s.AvgRTT > s.MaxRTT {
+			t.Errorf("%s: RTT min/avg/max = %v/%v/%v", tc.name, s.MinRTT, s.AvgRTT, s.MaxRTT)
+		}
+		if s.Goodput <= 0 {
+			t.Errorf("%s: Goodput = %v, want > 0", tc.name, s.Goodput)
+		}
+	}
+
+	recvA := reliable_udp.GetConnStatistics(receiverA)
+	if recvA.RecvPackets != 10 || recvA.SentPackets != 0 {
+		t.Errorf("Receiver a: RecvPackets = %d, SentPackets = %d; want 10, 0",
+			recvA.RecvPackets, recvA.SentPackets)
+	}
+
+	after := reliable_udp.GetStatistics()
+	if got := after.SentPackets - before.SentPackets; got < 35 {
+		t.Errorf("Aggregate SentPackets grew by %d, want at least 35", got)
+	}
+
+	reliable_udp.ResetConnStatistics(senderA)
+	if s := reliable_udp.GetConnStatistics(senderA); s.SentPackets != 0 || s.BytesAcked != 0 {
+		t.Errorf("Statistics after ResetConnStatistics = %+v", s)
+	}
+	if s := reliable_udp.GetConnStatistics(senderB); s.SentPackets != 25 {
+		t.Errorf("Resetting a changed b: SentPackets = %d", s.SentPackets)
+	}
+}
+
+func TestResetStatisticsClearsEverything(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+	reliable_udp.SetDropRate(20)
+	exchange(t, receiver, sender, 5, 10)
+
+	reliable_udp.ResetStatistics()
+	s := reliable_udp.GetStatistics()
+	if s.DropRate != 0 || s.DroppedPackets != 0 || s.SentPackets != 0 || s.BytesSent != 0 {
+		t.Errorf("Statistics after reset = %+v, want zero counters and drop rate", s)
+	}
+	if len(s.Retransmissions) != 0 {
+		t.Errorf("Retransmissions after reset = %v, want empty", s.Retransmissions)
+	}
+}
+
+func TestReleaseForgetsConnState(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+	exchange(t, receiver, sender, 5, 10)
+	before := reliable_udp.GetStatistics()
+
+	if s := reliable_udp.GetConnStatistics(sender); s.SentPackets != 5 {
+		t.Fatalf("SentPackets = %d, want 5", s.SentPackets)
+	}
+	reliable_udp.Release(sender)
+	reliable_udp.Release(receiver)
+
+	if s := reliable_udp.GetConnStatistics(sender); s.SentPackets != 0 {
+		t.Errorf("SentPackets after Release = %d, want 0", s.SentPackets)
+	}
+	if s := reliable_udp.GetConnStatistics(receiver); s.RecvPackets != 0 {
+		t.Errorf("RecvPackets after Release = %d, want 0", s.RecvPackets)
+	}
+	if after := reliable_udp.GetStatistics(); after.SentPackets < before.SentPackets {
+		t.Errorf("Aggregate SentPackets dropped from %d to %d", before.SentPackets, after.SentPackets)
+	}
+}
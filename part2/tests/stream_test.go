@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"part2/reliable_udp"
+	"testing"
+	"time"
+)
+
+// newStreamPair returns a dialed stream and the stream accepted for it
+func newStreamPair(t *testing.T, cfg reliable_udp.Config) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l, err := reliable_udp.ListenStream("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("ListenStream failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	client, err := reliable_udp.DialStream(l.Addr().String(), cfg)
+	if err != nil {
+		t.Fatalf("DialStream failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return client, server
+}
+
+func TestStreamCopyUnderLoss(t *testing.T) {
+	client, server := newStreamPair(t, reliable_udp.Config{})
+	reliable_udp.SetDropRate(5)
+	defer reliable_udp.SetDropRate(0)
+
+	want := make([]byte, 256*1024)
+	rand.Read(want)
+
+	go func() {
+		client.Write(want)
+		client.Close()
+	}()
+
+	server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("ReadAll failed after %d bytes: %v", len(got), err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Stream corrupted: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestStreamGob(t *testing.T) {
+	client, server := newStreamPair(t, reliable_udp.Config{})
+
+	type record struct {
+		Name  string
+		Value []int
+	}
+	sent := []record{{"a", []int{1, 2, 3}}, {"b", make([]int, 1000)}}
+
+	go func() {
+		enc := gob.NewEncoder(client)
+		for _, r := range sent {
+			enc.Encode(r)
+		}
+	}()
+
+	dec := gob.NewDecoder(server)
+	for i, want := range sent {
+		var got record
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("Decode %d failed: %v", i, err)
+		}
+		if got.Name != want.Name || len(got.Value) != len(want.Value) {
+			t.Errorf("Record %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, server := newStreamPair(t, reliable_udp.Config{})
+
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := server.Read(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Read error %v is not a net.Error timeout", err)
+	}
+
+	// Clearing the deadline makes the stream usable again
+	server.SetReadDeadline(time.Time{})
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, 10)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read after clearing deadline = %q, %v; want %q", buf[:n], err, "ping")
+	}
+}
@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"fmt"
+	"part2/reliable_udp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveAll collects count messages from ReceiveReliable, skipping
+// artificially dropped packets
+func receiveAll(count int, receive func() ([]byte, error)) ([]string, error) {
+	got := make([]string, 0, count)
+	for len(got) < count {
+		data, err := receive()
+		if err != nil {
+			if isTimeout(err) {
+				return got, fmt.Errorf("timed out after %d of %d messages", len(got), count)
+			}
+			continue
+		}
+		got = append(got, string(data))
+	}
+	return got, nil
+}
+
+func isTimeout(err error) bool {
+	return strings.Contains(err.Error(), "timeout")
+}
+
+func TestWindowSenderDeliversInOrderUnderLoss(t *testing.T) {
+	configs := []reliable_udp.Config{
+		{Mode: reliable_udp.ModeStopAndWait},
+		{Mode: reliable_udp.ModeSelectiveRepeat, WindowSize: 8},
+		{Mode: reliable_udp.ModeSelectiveRepeat, WindowSize: 32},
+		{Mode: reliable_udp.ModeGoBackN, WindowSize: 8},
+	}
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v_window%d", cfg.Mode, cfg.WindowSize), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			reliable_udp.SetDropRate(10)
+			defer reliable_udp.SetDropRate(0)
+
+			const count = 100
+			var got []string
+			var recvErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+				got, recvErr = receiveAll(count, func() ([]byte, error) {
+					data, _, err := reliable_udp.ReceiveReliable(receiver)
+					return data, err
+				})
+			}()
+
+			ws := reliable_udp.NewWindowSender(sender, cfg)
+			for i := 0; i < count; i++ {
+				if err := ws.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+					t.Fatalf("Send %d failed: %v", i, err)
+				}
+			}
+			if err := ws.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			<-done
+			if recvErr != nil {
+				t.Fatalf("Receive failed: %v", recvErr)
+			}
+			for i, msg := range got {
+				if want := fmt.Sprintf("msg-%d", i); msg != want {
+					t.Fatalf("Message %d = %q, want %q", i, msg, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveRTOTracksLoopbackRTT(t *testing.T) {
+	receiver, sender := newLoopbackPair(t)
+	go func() {
+		for {
+			if _, _, err := reliable_udp.ReceiveReliable(receiver); err != nil {
+				return
+			}
+		}
+	}()
+
+	cfg := reliable_udp.Config{MinRTO: 5 * time.Millisecond, MaxRTO: time.Second}
+	ws := reliable_udp.NewWindowSender(sender, cfg)
+	for i := 0; i < 50; i++ {
+		if err := ws.Send([]byte("ping")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if err := ws.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if ws.SRTT() <= 0 {
+		t.Errorf("SRTT = %v, want a measured value", ws.SRTT())
+	}
+	if rto := ws.RTO(); rto < cfg.MinRTO || rto >= reliable_udp.RetryTimeout {
+		t.Errorf("RTO = %v, want within [%v, %v)", rto, cfg.MinRTO, reliable_udp.RetryTimeout)
+	}
+	if stats := reliable_udp.GetStatistics(); stats.RTO <= 0 || stats.SRTT <= 0 {
+		t.Errorf("Statistics RTO/SRTT not reported: %+v", stats)
+	}
+}
+
+func TestRetransmissionsCountedPerMode(t *testing.T) {
+	for _, mode := range []reliable_udp.Mode{reliable_udp.ModeSelectiveRepeat, reliable_udp.ModeGoBackN} {
+		t.Run(mode.String(), func(t *testing.T) {
+			receiver, sender := newLoopbackPair(t)
+			reliable_udp.SetDropRate(20)
+			defer reliable_udp.SetDropRate(0)
+
+			const count = 50
+			done := make(chan error)
+			go func() {
+				receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+				_, err := receiveAll(count, func() ([]byte, error) {
+					data, _, err := reliable_udp.ReceiveReliable(receiver)
+					return data, err
+				})
+				done <- err
+			}()
+
+			ws := reliable_udp.NewWindowSender(sender, reliable_udp.Config{Mode: mode, WindowSize: 8})
+			for i := 0; i < count; i++ {
+				if err := ws.Send([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+					t.Fatalf("Send %d failed: %v", i, err)
+				}
+			}
+			if err := ws.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("Receive failed: %v", err)
+			}
+
+			s := reliable_udp.GetConnStatistics(sender)
+			if s.Retransmissions[mode] == 0 {
+				t.Errorf("Retransmissions[%v] = 0 with 20%% loss, want > 0", mode)
+			}
+			for other, n := range s.Retransmissions {
+				if other != mode && n != 0 {
+					t.Errorf("Retransmissions[%v] = %d, want 0", other, n)
+				}
+			}
+			if s.Retransmits != s.Retransmissions[mode] {
+				t.Errorf("Retransmits = %d, want Retransmissions[%v] = %d", s.Retransmits, mode, s.Retransmissions[mode])
+			}
+		})
+	}
+}